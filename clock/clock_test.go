@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	now := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFake(now)
+	if clock.Now() != now {
+		t.Fatalf("Expected %s, got %s", now, clock.Now())
+	}
+	expected := now.Add(time.Minute)
+	if got := clock.Advance(time.Minute); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+	expected = expected.Add(time.Hour)
+	if got := <-clock.After(time.Hour); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+	if clock.Now() != expected {
+		t.Fatalf("Expected %s, got %s", expected, clock.Now())
+	}
+	clock.Advance(-time.Hour)
+	if clock.Now() != expected {
+		t.Fatal("Expected clock to not move backwards")
+	}
+	clock.Set(now)
+	if clock.Now() != now {
+		t.Fatalf("Expected %s, got %s", now, clock.Now())
+	}
+}
+
+func TestOrReal(t *testing.T) {
+	if OrReal(nil) != Real {
+		t.Fatal("Expected real clock")
+	}
+	fake := NewFake(time.Time{})
+	if OrReal(fake) != fake {
+		t.Fatal("Expected fake clock")
+	}
+}
@@ -0,0 +1,248 @@
+// Package logger implements a levelled logger which writes structured
+// records as text, JSON or logfmt.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/mpolden/nrk-spotify/clock"
+)
+
+// Level is the severity of a record.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+// Format is the encoding of records.
+type Format string
+
+const (
+	// Text is a human readable format, which is colored if enabled
+	Text   Format = "text"
+	JSON   Format = "json"
+	Logfmt Format = "logfmt"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// levelColors are the colors of messages in the text format.
+var levelColors = []string{"dark_gray", "", "yellow", "red"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level: %q", name)
+}
+
+// ParseFormat returns the format named name.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case Text, JSON, Logfmt:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid log format: %q", name)
+}
+
+// Field is a key-value pair of a record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// output is the destination of a logger, shared by the loggers derived from
+// it.
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Logger writes records at or above its level.
+type Logger struct {
+	Level  Level
+	Format Format
+	// Colors enables colors in the text format
+	Colors bool
+	Clock  clock.Clock
+	out    *output
+	fields []Field
+}
+
+// New returns a logger writing to w.
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{Level: level, Format: format, out: &output{w: w}}
+}
+
+// IsTerminal returns true if f is an interactive terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// With returns a logger which adds fields to every record.
+func (l *Logger) With(fields ...Field) *Logger {
+	child := *l
+	child.fields = append(append([]Field(nil), l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.Log(Debug, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.Log(Info, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.Log(Warn, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.Log(Error, msg, fields...)
+}
+
+// Fatal writes an error record and exits.
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	l.Log(Error, msg, fields...)
+	os.Exit(1)
+}
+
+// Log writes a record at level, if it is enabled.
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	if level < l.Level {
+		return
+	}
+	now := clock.OrReal(l.Clock).Now()
+	all := append(append([]Field(nil), l.fields...), fields...)
+	var buf bytes.Buffer
+	switch l.Format {
+	case JSON:
+		writeJSON(&buf, now, level, msg, all)
+	case Logfmt:
+		writeLogfmt(&buf, now, level, msg, all)
+	default:
+		l.writeText(&buf, now, level, msg, all)
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// value returns the loggable value of v. Errors and durations are logged as
+// strings.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string,
+	fields []Field) {
+	buf.WriteString("{")
+	pairs := append([]Field{
+		F("time", now.Format(time.RFC3339Nano)),
+		F("level", level.String()),
+		F("msg", msg),
+	}, fields...)
+	for i, f := range pairs {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, _ := json.Marshal(f.Key)
+		v, err := json.Marshal(value(f.Value))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(f.Value))
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+}
+
+// logfmtValue formats v as a logfmt value, quoting it if necessary.
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(value(v))
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) ||
+			!unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func writeLogfmt(buf *bytes.Buffer, now time.Time, level Level, msg string,
+	fields []Field) {
+	fmt.Fprintf(buf, "time=%s level=%s msg=%s",
+		now.Format(time.RFC3339Nano), level, logfmtValue(msg))
+	for _, f := range fields {
+		fmt.Fprintf(buf, " %s=%s", f.Key, logfmtValue(f.Value))
+	}
+	buf.WriteString("\n")
+}
+
+func (l *Logger) writeText(buf *bytes.Buffer, now time.Time, level Level,
+	msg string, fields []Field) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	label := fmt.Sprintf("%-5s ", strings.ToUpper(level.String()))
+	color := ""
+	if level >= Debug && level <= Error {
+		color = levelColors[level]
+	}
+	if l.Colors && color != "" {
+		c := colorstring.Colorize{
+			Colors: colorstring.DefaultColors,
+			Reset:  true,
+		}
+		buf.WriteString(c.Color("[" + color + "]" + label + msg))
+	} else {
+		buf.WriteString(label + msg)
+	}
+	for _, f := range fields {
+		fmt.Fprintf(buf, " %s=%s", f.Key, logfmtValue(f.Value))
+	}
+	buf.WriteString("\n")
+}
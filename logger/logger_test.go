@@ -0,0 +1,103 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+)
+
+var testTime = time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestLogger(format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, format, Info)
+	l.Clock = clock.NewFake(testTime)
+	return l, &buf
+}
+
+func TestFormats(t *testing.T) {
+	var tests = []struct {
+		format Format
+		out    string
+	}{
+		{Text, "2015/01/01 12:00:00 WARN  Track not found channel=p3 " +
+			"track=\"Bob Dylan - Hurricane\" attempt=2 " +
+			"delay=1.5s error=\"gopher says \\\"no\\\"\"\n"},
+		{Logfmt, "time=2015-01-01T12:00:00Z level=warn " +
+			"msg=\"Track not found\" channel=p3 " +
+			"track=\"Bob Dylan - Hurricane\" attempt=2 " +
+			"delay=1.5s error=\"gopher says \\\"no\\\"\"\n"},
+		{JSON, `{"time":"2015-01-01T12:00:00Z","level":"warn",` +
+			`"msg":"Track not found","channel":"p3",` +
+			`"track":"Bob Dylan - Hurricane","attempt":2,` +
+			`"delay":"1.5s","error":"gopher says \"no\""}` + "\n"},
+	}
+	for _, tt := range tests {
+		l, buf := newTestLogger(tt.format)
+		l.With(F("channel", "p3")).Warn("Track not found",
+			F("track", "Bob Dylan - Hurricane"), F("attempt", 2),
+			F("delay", 1500*time.Millisecond),
+			F("error", fmt.Errorf(`gopher says "no"`)))
+		if buf.String() != tt.out {
+			t.Errorf("%s: Expected %q, got %q", tt.format, tt.out,
+				buf.String())
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	l, buf := newTestLogger(Logfmt)
+	l.Debug("Searching")
+	if buf.Len() != 0 {
+		t.Fatalf("Expected debug record to be filtered, got %q",
+			buf.String())
+	}
+	l.Level = Debug
+	l.Debug("Searching")
+	expected := "time=2015-01-01T12:00:00Z level=debug msg=Searching\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestWith(t *testing.T) {
+	l, buf := newTestLogger(Logfmt)
+	child := l.With(F("channel", "p3"))
+	child.With(F("radio", "NRK P3"))
+	l.Info("Parent")
+	child.Info("Child", F("empty", ""))
+	expected := "time=2015-01-01T12:00:00Z level=info msg=Parent\n" +
+		"time=2015-01-01T12:00:00Z level=info msg=Child channel=p3 " +
+		"empty=\"\"\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestColors(t *testing.T) {
+	l, buf := newTestLogger(Text)
+	l.Colors = true
+	l.Error("Sync failed")
+	expected := "2015/01/01 12:00:00 \033[31mERROR Sync failed\033[0m\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestParse(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != Warn {
+		t.Errorf("Expected warn, got %s (%v)", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected error")
+	}
+	if format, err := ParseFormat("JSON"); err != nil || format != JSON {
+		t.Errorf("Expected json, got %s (%v)", format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected error")
+	}
+}
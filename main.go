@@ -1,41 +1,258 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/docopt/docopt-go"
+	"github.com/mpolden/nrk-spotify/logger"
 	"github.com/mpolden/nrk-spotify/nrk"
 	"github.com/mpolden/nrk-spotify/server"
 	"github.com/mpolden/nrk-spotify/spotify"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+	"github.com/mpolden/nrk-spotify/watch"
 )
 
-func makeSpotifyAuth(args map[string]interface{}) (string, *spotify.Auth) {
+func makeAccounts(args map[string]interface{}) *spotify.Accounts {
+	return &spotify.Accounts{Dir: args["--accounts-dir"].(string)}
+}
+
+func tokenFile(args map[string]interface{}) (string, error) {
+	account, ok := args["--account"].(string)
+	if !ok {
+		return args["--token-file"].(string), nil
+	}
+	return makeAccounts(args).Create(account)
+}
+
+// loadSpotify reads the token of the account or token file, without making
+// requests.
+func loadSpotify(args map[string]interface{}) (*spotify.Spotify, error) {
+	var s *spotify.Spotify
+	var err error
+	if account, ok := args["--account"].(string); ok {
+		s, err = makeAccounts(args).Load(account)
+	} else {
+		s, err = spotify.Load(args["--token-file"].(string))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The API and accounts service are served from the same URL by
+	// fake-spotify
+	if url, ok := args["--spotify-url"].(string); ok {
+		s.APIURL = strings.TrimSuffix(url, "/") + "/v1"
+		s.AccountsURL = strings.TrimSuffix(url, "/")
+	}
+	return s, nil
+}
+
+func openSpotify(args map[string]interface{}) (*spotify.Spotify, error) {
+	s, err := loadSpotify(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func makeSpotifyAuth(args map[string]interface{}) (string, *spotify.Auth,
+	error) {
 	clientId := args["<client-id>"].(string)
 	clientSecret := args["<client-secret>"].(string)
 	listen := args["--listen"].(string)
-	tokenFile := args["--token-file"].(string)
+	tokenFile, err := tokenFile(args)
+	if err != nil {
+		return "", nil, err
+	}
 	return listen, &spotify.Auth{
 		ClientId:     clientId,
 		ClientSecret: clientSecret,
 		TokenFile:    tokenFile,
+	}, nil
+}
+
+func listAccounts(args map[string]interface{}) error {
+	accounts, err := makeAccounts(args).List()
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		fmt.Println("No accounts found")
+		return nil
+	}
+	for _, a := range accounts {
+		fmt.Printf("%s (%s) %s\n", a.Name, a.ProfileId, a.TokenFile)
 	}
+	return nil
+}
+
+func removeAccount(args map[string]interface{}) error {
+	account := args["<account>"].(string)
+	if err := makeAccounts(args).Remove(account); err != nil {
+		return err
+	}
+	fmt.Printf("Removed account %s\n", account)
+	return nil
+}
+
+func tokenCommand(args map[string]interface{}) error {
+	// Only refresh may change the token, status and revoke must work
+	// with tokens which the API does not accept
+	open := loadSpotify
+	if args["refresh"].(bool) {
+		open = openSpotify
+	}
+	s, err := open(args)
+	if err != nil {
+		return err
+	}
+	var result interface{}
+	var failed error
+	switch {
+	case args["refresh"].(bool):
+		if err := s.Refresh(); err != nil {
+			failed = err
+		}
+		result = s.TokenStatus()
+	case args["revoke"].(bool):
+		if err := s.Revoke(); err != nil {
+			return err
+		}
+		result = map[string]interface{}{
+			"token_file": s.Auth.TokenFile,
+			"revoked":    true,
+		}
+	default:
+		status := s.TokenStatus()
+		if !status.Valid {
+			failed = fmt.Errorf("token is invalid: %s", status.Error)
+		}
+		result = status
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return failed
+}
+
+func fakeSpotify(args map[string]interface{}) error {
+	listen := args["--listen"].(string)
+	tokenFile, err := tokenFile(args)
+	if err != nil {
+		return err
+	}
+	// A token with client credentials was written by auth, and must not be
+	// replaced by a fake one
+	if existing, err := spotify.Load(tokenFile); err == nil &&
+		existing.Auth.ClientId != "" {
+		return fmt.Errorf("%s contains a Spotify token, "+
+			"use another file for the fake", tokenFile)
+	}
+	fake := spotifytest.New()
+	fake.AutoCatalog = true
+	if strings.HasPrefix(listen, ":") {
+		fake.URL = "http://localhost" + listen
+	} else {
+		fake.URL = "http://" + listen
+	}
+	s := fake.Spotify()
+	s.Auth.TokenFile = tokenFile
+	if err := s.Save(tokenFile); err != nil {
+		return err
+	}
+	log.Printf("Serving fake Spotify API on %s", fake.URL)
+	log.Printf("Wrote token file to %s, use it with -U %s", tokenFile,
+		fake.URL)
+	return http.ListenAndServe(listen, fake)
+}
+
+func makeDirectory(args map[string]interface{}) *nrk.Directory {
+	return &nrk.Directory{
+		CacheFile: args["--channels-cache"].(string),
+		Logger:    server.Log,
+	}
+}
+
+func listChannels(args map[string]interface{}) error {
+	channels, err := makeDirectory(args).Channels()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tLIVE")
+	for _, c := range channels {
+		live := "unknown"
+		if c.Checked && c.LiveElements {
+			live = "yes"
+		} else if c.Checked {
+			live = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.ID, c.Name, live)
+	}
+	return w.Flush()
+}
+
+// configureLog configures the log of syncs. Colors are only used when
+// logging text to a terminal.
+func configureLog(args map[string]interface{}) error {
+	format, err := logger.ParseFormat(args["--log-format"].(string))
+	if err != nil {
+		return err
+	}
+	level, err := logger.ParseLevel(args["--log-level"].(string))
+	if err != nil {
+		return err
+	}
+	server.Log.Format = format
+	server.Log.Level = level
+	server.Log.Colors = args["--colors"].(bool) && format == logger.Text &&
+		logger.IsTerminal(os.Stderr)
+	return nil
 }
 
 func makeServer(args map[string]interface{}) (*server.Sync, error) {
-	radioName := args["<name>"].(string)
-	radioID := args["<radio-id>"].(string)
-	tokenFile := args["--token-file"].(string)
+	if err := configureLog(args); err != nil {
+		return nil, err
+	}
+	s, err := openSpotify(args)
+	if err != nil {
+		return nil, err
+	}
+	return makeSync(args, s, args["<name>"].(string),
+		args["<radio-id>"].(string))
+}
+
+// makeSync returns a sync of the radio radioID to the playlist radioName.
+// Syncs running concurrently share s, so that its token is refreshed and saved
+// by one of them at a time.
+func makeSync(args map[string]interface{}, s *spotify.Spotify, radioName,
+	radioID string) (*server.Sync, error) {
 	adaptive := args["--adaptive"].(bool)
 	deleteEvicted := args["--delete-evicted"].(bool)
 	intervalOpt := args["--interval"].(string)
 	memProfile, ok := args["--memprofile"].(string)
-	colors := args["--colors"].(bool)
 	if !ok {
 		memProfile = ""
 	}
+	var history *server.History
+	if historyFile, ok := args["--history"].(string); ok {
+		history = &server.History{File: historyFile}
+	}
 	interval, err := strconv.Atoi(intervalOpt)
 	if err != nil || interval < 1 {
 		return nil, fmt.Errorf("--interval must be an positive integer")
@@ -46,65 +263,433 @@ func makeServer(args map[string]interface{}) (*server.Sync, error) {
 		return nil, fmt.Errorf(
 			"--cache-size must be an positive integer")
 	}
-	s, err := spotify.New(tokenFile)
-	if err != nil {
-		return nil, err
+	directory := makeDirectory(args)
+	var metrics *server.Metrics
+	if _, ok := args["--status"].(string); ok {
+		metrics = server.NewMetrics(radioID)
+		transport := metrics.Transport("spotify", spotify.Transport)
+		s.Client = &http.Client{Transport: transport}
+		directory.Client = &http.Client{
+			Transport: metrics.Transport("nrk", nrk.Transport),
+		}
 	}
-	radio, err := nrk.New(radioName, radioID)
+	radio, err := directory.Radio(radioName, radioID)
 	if err != nil {
 		return nil, err
 	}
-	server.Colorize.Disable = !colors
+	var rules []server.Rule
+	if rulesFile, ok := args["--rules"].(string); ok {
+		rules, err = server.ReadRules(rulesFile,
+			func(name string) server.PlaylistSink {
+				return spotify.NewSink(s, name)
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var schedule server.ScheduleSource
+	if args["--schedule"].(bool) || rules != nil {
+		schedule = radio
+	}
+	log := server.Log.With(logger.F("channel", radioID))
+	var notifier *server.Notifier
+	if webhooksFile, ok := args["--webhooks"].(string); ok {
+		notifier, err = server.ReadWebhooks(webhooksFile)
+		if err != nil {
+			return nil, err
+		}
+		notifier.Channel = radioID
+		notifier.Logger = log
+	}
 	return &server.Sync{
-		Spotify:       s,
 		Radio:         radio,
+		Playlist:      spotify.NewSink(s, radioName),
 		Interval:      time.Duration(interval) * time.Minute,
 		Adaptive:      adaptive,
 		CacheSize:     cacheSize,
 		DeleteEvicted: deleteEvicted,
+		DryRun:        args["--dry-run"].(bool),
 		MemProfile:    memProfile,
+		History:       history,
+		Schedule:      schedule,
+		Rules:         rules,
+		Metrics:       metrics,
+		Notifier:      notifier,
+		Logger:        log,
 	}, nil
 }
 
+// parseTime parses a time given on the command line, relative to now.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value,
+		now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", value,
+		now.Location()); err == nil {
+		y, m, d := now.Date()
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0,
+			now.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %q", value)
+}
+
+func backfill(args map[string]interface{}) error {
+	if err := configureLog(args); err != nil {
+		return err
+	}
+	radioName := args["<name>"].(string)
+	radioID := args["<radio-id>"].(string)
+	now := time.Now()
+	from, err := parseTime(args["--from"].(string), now)
+	if err != nil {
+		return err
+	}
+	to := now
+	if value, ok := args["--to"].(string); ok {
+		if to, err = parseTime(value, now); err != nil {
+			return err
+		}
+	}
+	s, err := openSpotify(args)
+	if err != nil {
+		return err
+	}
+	var source server.HistorySource
+	if historyFile, ok := args["--history"].(string); ok {
+		source = &server.History{File: historyFile}
+	} else {
+		radio, err := makeDirectory(args).Radio(radioName, radioID)
+		if err != nil {
+			return err
+		}
+		source = radio
+	}
+	log := server.Log.With(logger.F("channel", radioID))
+	sync := &server.Sync{
+		Playlist: spotify.NewSink(s, radioName),
+		Logger:   log,
+	}
+	result, err := sync.Backfill(source, from, to)
+	if err != nil {
+		return err
+	}
+	log.Info("Backfill finished", logger.F("source", source.String()),
+		logger.F("added", len(result.Added)),
+		logger.F("present", result.Present),
+		logger.F("not_found", result.NotFound),
+		logger.F("not_music", result.NotMusic),
+		logger.F("failed", result.Failed))
+	return nil
+}
+
+func reconcile(args map[string]interface{}) error {
+	if err := configureLog(args); err != nil {
+		return err
+	}
+	cacheSize, err := strconv.Atoi(args["--cache-size"].(string))
+	if err != nil || cacheSize < 1 {
+		return fmt.Errorf("--cache-size must be an positive integer")
+	}
+	var source server.HistorySource
+	var from, to time.Time
+	if historyFile, ok := args["--history"].(string); ok {
+		source = &server.History{File: historyFile}
+		to = time.Now()
+		if value, ok := args["--from"].(string); ok {
+			if from, err = parseTime(value, to); err != nil {
+				return err
+			}
+		}
+		if value, ok := args["--to"].(string); ok {
+			if to, err = parseTime(value, to); err != nil {
+				return err
+			}
+		}
+	}
+	s, err := openSpotify(args)
+	if err != nil {
+		return err
+	}
+	sync := &server.Sync{
+		Playlist:  spotify.NewSink(s, args["<playlist>"].(string)),
+		CacheSize: cacheSize,
+		DryRun:    args["--dry-run"].(bool),
+	}
+	r, err := sync.Reconcile(source, from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", sync.Playlist, r)
+	list := func(label string, tracks []spotify.Track) {
+		for _, t := range tracks {
+			fmt.Printf("  %-10s %s\n", label, t.String())
+		}
+	}
+	list("duplicate", r.Duplicates)
+	list("excess", r.Excess)
+	list("foreign", r.Foreign)
+	list("missing", r.Missing)
+	if !args["--fix"].(bool) {
+		return nil
+	}
+	return sync.Repair(r)
+}
+
+// parseChannel parses a channel given as <radio-id>[=<playlist>]. The
+// playlist defaults to the name of the channel.
+func parseChannel(value string, channels []nrk.Channel) (watch.Channel,
+	error) {
+	parts := strings.SplitN(value, "=", 2)
+	c := watch.Channel{ID: parts[0]}
+	for _, ch := range channels {
+		if ch.ID == c.ID {
+			c.Name = ch.Name
+		}
+	}
+	if c.Name == "" {
+		return watch.Channel{}, fmt.Errorf("%s is not a valid radio ID",
+			c.ID)
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		c.Name = parts[1]
+	}
+	return c, nil
+}
+
+func watchChannels(args map[string]interface{}) error {
+	tail := watch.NewTail(5)
+	server.Log = logger.New(tail, logger.Text, logger.Info)
+	channels, err := makeDirectory(args).Channels()
+	if err != nil {
+		return err
+	}
+	s, err := openSpotify(args)
+	if err != nil {
+		return err
+	}
+	dashboard := &watch.Dashboard{
+		Log:    tail,
+		Colors: args["--colors"].(bool) && logger.IsTerminal(os.Stdout),
+	}
+	var syncs []*server.Sync
+	for _, value := range args["<channel>"].([]string) {
+		c, err := parseChannel(value, channels)
+		if err != nil {
+			return err
+		}
+		sync, err := makeSync(args, s, c.Name, c.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Initializing %s\n", c.Name)
+		if err := sync.Init(); err != nil {
+			return err
+		}
+		c.Source = sync
+		syncs = append(syncs, sync)
+		dashboard.Channels = append(dashboard.Channels, c)
+	}
+	for _, sync := range syncs {
+		go sync.Run()
+	}
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	dashboard.Run(os.Stdout, time.Second, stop)
+	return nil
+}
+
+// printResult writes the result of running channel c once to w.
+func printResult(w io.Writer, c watch.Channel, result *server.RunResult,
+	err error) {
+	if err != nil {
+		fmt.Fprintf(w, "%s (%s): failed: %s\n", c.Name, c.ID, err)
+	}
+	if result == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s (%s): %s\n", c.Name, c.ID, result)
+	list := func(symbol string, tracks []nrk.Track) {
+		for _, t := range tracks {
+			fmt.Fprintf(w, "  %s %s\n", symbol, t.String())
+		}
+	}
+	list("+", result.Added)
+	list("=", result.Present)
+	list("?", result.NotFound)
+	list("-", result.Skipped)
+}
+
+// syncChannels runs the sync of each channel once and prints what was done.
+// It fails if any channel failed.
+func syncChannels(args map[string]interface{}) error {
+	if err := configureLog(args); err != nil {
+		return err
+	}
+	channels, err := makeDirectory(args).Channels()
+	if err != nil {
+		return err
+	}
+	s, err := openSpotify(args)
+	if err != nil {
+		return err
+	}
+	values := args["<channel>"].([]string)
+	failed := 0
+	for _, value := range values {
+		c, err := parseChannel(value, channels)
+		if err != nil {
+			return err
+		}
+		sync, err := makeSync(args, s, c.Name, c.ID)
+		if err != nil {
+			return err
+		}
+		var result *server.RunResult
+		if err = sync.Init(); err == nil {
+			result, err = sync.RunOnce()
+		}
+		if sync.Notifier != nil {
+			sync.Notifier.Wait()
+		}
+		printResult(os.Stdout, c, result, err)
+		if err != nil || result.Failed > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("sync of %d of %d channels failed", failed,
+			len(values))
+	}
+	return nil
+}
+
 func main() {
 	usage := `Listen to NRK radio channels in Spotify.
 
 Usage:
-  nrk-spotify auth [-l <address>] [-f <file>] <client-id> <client-secret>
-  nrk-spotify server [-f <file>] [-i <minutes>] [-a] [-d] [-c <max>] [-p <file>] [-x] <name> <radio-id>
-  nrk-spotify list
+  nrk-spotify auth [-l <address>] [-f <file> | -A <account>] [-D <dir>] <client-id> <client-secret>
+  nrk-spotify server [-f <file> | -A <account>] [-D <dir>] [-U <url>] [-i <minutes>] [-a] [-d] [-n] [-c <max>] [-p <file>] [-x] [-C <file>] [-H <file>] [-S] [-R <file>] [-L <address>] [-W <file>] [--log-format=<format>] [--log-level=<level>] <name> <radio-id>
+  nrk-spotify backfill [-f <file> | -A <account>] [-D <dir>] [-U <url>] [-C <file>] [-H <file>] [-x] [--log-format=<format>] [--log-level=<level>] --from=<time> [--to=<time>] <name> <radio-id>
+  nrk-spotify sync [-f <file> | -A <account>] [-D <dir>] [-U <url>] [-d] [-n] [-c <max>] [-x] [-C <file>] [-H <file>] [-S] [-R <file>] [-W <file>] [--log-format=<format>] [--log-level=<level>] <channel>...
+  nrk-spotify reconcile [-f <file> | -A <account>] [-D <dir>] [-U <url>] [-c <max>] [-H <file>] [--from=<time>] [--to=<time>] [-n] [--fix] [-x] [--log-format=<format>] [--log-level=<level>] <playlist>
+  nrk-spotify watch [-f <file> | -A <account>] [-D <dir>] [-U <url>] [-i <minutes>] [-a] [-d] [-n] [-c <max>] [-x] [-C <file>] <channel>...
+  nrk-spotify fake-spotify [-l <address>] (-f <file> | -A <account>) [-D <dir>]
+  nrk-spotify token (status | refresh | revoke) [-f <file> | -A <account>] [-D <dir>] [-U <url>]
+  nrk-spotify accounts list [-D <dir>]
+  nrk-spotify accounts remove [-D <dir>] <account>
+  nrk-spotify list [-C <file>]
   nrk-spotify -h | --help
 
 Options:
-  -h --help                Show help
-  -f --token-file=<file>   Token file to use [default: .token.json]
-  -l --listen=<address>    Auth server listening address [default: :8080]
-  -i --interval=<minutes>  Polling interval [default: 5]
-  -c --cache-size=<max>    Max entries to keep in cache [default: 100]
-  -a --adaptive            Automatically determine sync interval
-  -d --delete-evicted      Delete evicted (uncached) tracks from playlist
-  -x --colors              Use colors in log output
-  -p --memprofile=<file>   Write heap profile after each run. Debug option`
+  -h --help                   Show help
+  -f --token-file=<file>      Token file to use [default: .token.json]
+  -A --account=<name>         Named account to use instead of token file
+  -D --accounts-dir=<dir>     Directory containing named accounts [default: .accounts]
+  -U --spotify-url=<url>      Use the Spotify API at url, such as a fake-spotify server
+  -l --listen=<address>       Auth or fake server listening address [default: :8080]
+  -i --interval=<minutes>     Polling interval [default: 5]
+  -c --cache-size=<max>       Max entries to keep in cache [default: 100]
+  -a --adaptive               Automatically determine sync interval
+  -d --delete-evicted         Delete evicted (uncached) tracks from playlist
+  -n --dry-run                Search, but only log tracks to add and delete
+  -x --colors                 Use colors in text logs and dashboard on a terminal
+  --log-format=<format>       Log format: text, json or logfmt [default: text]
+  --log-level=<level>         Log level: debug, info, warn or error [default: info]
+  -C --channels-cache=<file>  Cache file for discovered channels [default: .channels.json]
+  -H --history=<file>         Play history, recorded by server and read by backfill and reconcile
+  --from=<time>               Backfill or reconcile from time, as RFC 3339, YYYY-MM-DDTHH:MM or HH:MM
+  --to=<time>                 Backfill or reconcile until time, defaults to now
+  -S --schedule               Fetch programme schedule and tag plays with programme
+  -R --rules=<file>           Per-programme playlists and skips. Implies --schedule
+  --fix                       Make the playlist contain the expected tracks
+  -L --status=<address>       Serve status, health and metrics API on address
+  -W --webhooks=<file>        Notify webhooks of sync events
+  -p --memprofile=<file>      Write heap profile after each run. Debug option`
 
 	arguments, _ := docopt.Parse(usage, nil, true, "", false)
 	auth := arguments["auth"].(bool)
-	server := arguments["server"].(bool)
+	serverCmd := arguments["server"].(bool)
+	accounts := arguments["accounts"].(bool)
+	token := arguments["token"].(bool)
+	fake := arguments["fake-spotify"].(bool)
+	backfillCmd := arguments["backfill"].(bool)
+	watchCmd := arguments["watch"].(bool)
+	syncCmd := arguments["sync"].(bool)
+	reconcileCmd := arguments["reconcile"].(bool)
 
 	if auth {
-		listen, spotifyAuth := makeSpotifyAuth(arguments)
+		listen, spotifyAuth, err := makeSpotifyAuth(arguments)
+		if err != nil {
+			log.Fatal(err)
+		}
 		if err := spotifyAuth.Serve(listen); err != nil {
 			log.Fatalf("Failed to start auth server: %s", err)
 		}
-	} else if server {
-		server, err := makeServer(arguments)
+	} else if serverCmd {
+		sync, err := makeServer(arguments)
+		if err != nil {
+			server.Log.Fatal("Failed to initialize server",
+				logger.F("error", err))
+		}
+		if listen, ok := arguments["--status"].(string); ok {
+			handler := sync.Handler()
+			go func() {
+				server.Log.Info("Serving status API",
+					logger.F("address", listen))
+				err := http.ListenAndServe(listen, handler)
+				server.Log.Fatal("Status API failed",
+					logger.F("error", err))
+			}()
+		}
+		sync.Serve()
+	} else if backfillCmd {
+		if err := backfill(arguments); err != nil {
+			server.Log.Fatal("Backfill failed",
+				logger.F("error", err))
+		}
+	} else if watchCmd {
+		if err := watchChannels(arguments); err != nil {
+			log.Fatal(err)
+		}
+	} else if reconcileCmd {
+		if err := reconcile(arguments); err != nil {
+			server.Log.Fatal("Reconcile failed",
+				logger.F("error", err))
+		}
+	} else if syncCmd {
+		if err := syncChannels(arguments); err != nil {
+			server.Log.Fatal("Sync failed", logger.F("error", err))
+		}
+	} else if fake {
+		if err := fakeSpotify(arguments); err != nil {
+			log.Fatal(err)
+		}
+	} else if token {
+		if err := tokenCommand(arguments); err != nil {
+			log.Fatal(err)
+		}
+	} else if accounts {
+		var err error
+		if arguments["remove"].(bool) {
+			err = removeAccount(arguments)
+		} else {
+			err = listAccounts(arguments)
+		}
 		if err != nil {
-			log.Fatalf("Failed to initialize server: %s", err)
+			log.Fatal(err)
 		}
-		server.Serve()
 	} else {
-		fmt.Println("Available radio IDs:")
-		for _, id := range nrk.IDs() {
-			fmt.Println(id)
+		if err := listChannels(arguments); err != nil {
+			log.Fatal(err)
 		}
 	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/spotify"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func TestMain(m *testing.M) {
+	// Requests which escape the fake servers fail
+	spotify.Transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Hostname() != "127.0.0.1" {
+			return nil, fmt.Errorf("request escaped to %s",
+				req.URL.Host)
+		}
+		return nil, nil
+	}
+	os.Exit(m.Run())
+}
+
+func TestOpenSpotifyURL(t *testing.T) {
+	fake := spotifytest.NewServer()
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "nrk-spotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token.json")
+	// The profile is unknown, so opening the token requests it
+	token := fake.Spotify()
+	token.Profile.Id = ""
+	if err := token.Save(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSpotify(map[string]interface{}{
+		"--token-file":  tokenFile,
+		"--spotify-url": fake.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Profile.Id != "gopher" {
+		t.Fatalf("Expected profile gopher, got %q", s.Profile.Id)
+	}
+	if n := fake.Count("GET", "/v1/me"); n != 1 {
+		t.Fatalf("Expected 1 profile request, got %d", n)
+	}
+}
+
+func TestTokenStatusAndRevoke(t *testing.T) {
+	fake := spotifytest.NewServer()
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "nrk-spotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token.json")
+	token := fake.Spotify()
+	token.Profile.Id = ""
+	token.ExpiresAt = time.Now().Add(-time.Hour)
+	if err := token.Save(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := map[string]interface{}{
+		"refresh":       false,
+		"revoke":        false,
+		"--token-file":  tokenFile,
+		"--spotify-url": fake.URL,
+	}
+
+	// The status of an expired token is read without requests
+	if err := tokenCommand(args); err == nil {
+		t.Fatal("Expected expired token to be invalid")
+	}
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Fatalf("Expected no requests, got %+v", requests)
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(saved) {
+		t.Fatalf("Expected token file to be unchanged, got %s", data)
+	}
+
+	// And the token can still be revoked
+	args["revoke"] = true
+	if err := tokenCommand(args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected token file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package metrics implements counters, gauges and histograms which can be
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suitable for request latencies, in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+	5, 10}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+// Registry is a set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+type family struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// Histogram state. counts[i] is the number of observations in bucket i
+	counts []uint64
+	count  uint64
+}
+
+// Vec is a family of metrics, partitioned by label values.
+type Vec struct {
+	family *family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name, help string, kind kind, labels []string,
+	buckets []float64) Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic(fmt.Sprintf("metric %s already registered", name))
+		}
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return Vec{family: f}
+}
+
+// Counter registers a counter.
+func (r *Registry) Counter(name, help string, labels ...string) Vec {
+	return r.register(name, help, counter, labels, nil)
+}
+
+// Gauge registers a gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) Vec {
+	return r.register(name, help, gauge, labels, nil)
+}
+
+// Histogram registers a histogram with the given upper bucket bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64,
+	labels ...string) Vec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return r.register(name, help, histogram, labels, sorted)
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values",
+			f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add adds delta to the counter or gauge with the given label values.
+func (v Vec) Add(delta float64, values ...string) {
+	if v.family.kind == counter && delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", v.family.name))
+	}
+	v.family.mu.Lock()
+	defer v.family.mu.Unlock()
+	v.family.with(values).value += delta
+}
+
+// Inc adds one to the counter or gauge with the given label values.
+func (v Vec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Set sets the gauge with the given label values.
+func (v Vec) Set(value float64, values ...string) {
+	if v.family.kind != gauge {
+		panic(fmt.Sprintf("%s %s cannot be set", v.family.kind,
+			v.family.name))
+	}
+	v.family.mu.Lock()
+	defer v.family.mu.Unlock()
+	v.family.with(values).value = value
+}
+
+// Observe records value in the histogram with the given label values.
+func (v Vec) Observe(value float64, values ...string) {
+	if v.family.kind != histogram {
+		panic(fmt.Sprintf("%s %s cannot observe", v.family.kind,
+			v.family.name))
+	}
+	v.family.mu.Lock()
+	defer v.family.mu.Unlock()
+	s := v.family.with(values)
+	for i, upper := range v.family.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Value returns the value of the counter or gauge with the given label
+// values, or the number of observations of a histogram.
+func (v Vec) Value(values ...string) float64 {
+	v.family.mu.Lock()
+	defer v.family.mu.Unlock()
+	s, ok := v.family.series[strings.Join(values, "\xff")]
+	if !ok {
+		return 0
+	}
+	if v.family.kind == histogram {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name,
+			labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i],
+			extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (f *family) write(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name,
+		help, f.name, f.kind); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != histogram {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name,
+				formatLabels(f.labels, s.values),
+				formatValue(s.value)); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, upper := range f.buckets {
+			labels := formatLabels(f.labels, s.values, "le",
+				formatValue(upper))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+				labels, s.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n"+
+			"%s_count%s %d\n",
+			f.name, formatLabels(f.labels, s.values, "le", "+Inf"),
+			s.count,
+			f.name, formatLabels(f.labels, s.values),
+			formatValue(s.value),
+			f.name, formatLabels(f.labels, s.values),
+			s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves all metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
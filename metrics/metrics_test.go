@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	runs := r.Counter("runs_total", "Number of runs.", "channel")
+	cache := r.Gauge("cache_entries", "Cache\nentries.", "channel")
+	latency := r.Histogram("latency_seconds", "Latency.",
+		[]float64{1, 0.1}, "api")
+	r.Counter("unused_total", "Not written.")
+
+	runs.Inc("p3")
+	runs.Add(2, "p3")
+	runs.Inc(`p"1`)
+	cache.Set(42, "p3")
+	latency.Observe(0.05, "nrk")
+	latency.Observe(0.5, "nrk")
+	latency.Observe(5, "nrk")
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP runs_total Number of runs.
+# TYPE runs_total counter
+runs_total{channel="p\"1"} 1
+runs_total{channel="p3"} 3
+# HELP cache_entries Cache\nentries.
+# TYPE cache_entries gauge
+cache_entries{channel="p3"} 42
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{api="nrk",le="0.1"} 1
+latency_seconds_bucket{api="nrk",le="1"} 2
+latency_seconds_bucket{api="nrk",le="+Inf"} 3
+latency_seconds_sum{api="nrk"} 5.55
+latency_seconds_count{api="nrk"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+	if v := runs.Value("p3"); v != 3 {
+		t.Fatalf("Expected 3, got %f", v)
+	}
+	if v := latency.Value("nrk"); v != 3 {
+		t.Fatalf("Expected 3 observations, got %f", v)
+	}
+	if v := runs.Value("p1"); v != 0 {
+		t.Fatalf("Expected 0, got %f", v)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") ||
+		w.Body.String() != expected {
+		t.Fatalf("Unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	runs := r.Counter("runs_total", "Number of runs.", "channel")
+	for name, fn := range map[string]func(){
+		"duplicate":   func() { r.Counter("runs_total", "Again.") },
+		"labels":      func() { runs.Inc() },
+		"decrease":    func() { runs.Add(-1, "p3") },
+		"set counter": func() { runs.Set(1, "p3") },
+		"observe":     func() { runs.Observe(1, "p3") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,227 @@
+package nrk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
+)
+
+const DefaultChannelTTL = 24 * time.Hour
+
+var names = map[string]string{
+	"p1pluss":           "NRK P1+",
+	"p2":                "NRK P2",
+	"p3":                "NRK P3",
+	"p13":               "NRK P13",
+	"mp3":               "NRK mP3",
+	"radio_super":       "NRK Super",
+	"klassisk":          "NRK Klassisk",
+	"jazz":              "NRK Jazz",
+	"folkemusikk":       "NRK Folkemusikk",
+	"urort":             "NRK P3 Urørt",
+	"radioresepsjonen":  "NRK P3 Radioresepsjonen",
+	"national_rap_show": "NRK P3 National Rap Show",
+	"pyro":              "NRK P3 Pyro",
+}
+
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Checked is true if LiveElements has been determined
+	Checked      bool `json:"checked"`
+	LiveElements bool `json:"live_elements"`
+}
+
+type Directory struct {
+	// CacheFile is where discovered channels are cached. Caching is
+	// disabled if empty
+	CacheFile string
+	TTL       time.Duration
+	BaseURL   string
+	Clock     clock.Clock
+	Client    *http.Client
+	// Logger receives errors which do not prevent returning channels, if
+	// set
+	Logger *logger.Logger
+}
+
+type channelCache struct {
+	Updated  time.Time `json:"updated"`
+	Channels []Channel `json:"channels"`
+}
+
+type channelListing struct {
+	ID    string `json:"channelId"`
+	Title string `json:"title"`
+}
+
+// BuiltinChannels returns the channels known at compile time.
+func BuiltinChannels() []Channel {
+	channels := make([]Channel, len(ids))
+	for i, id := range ids {
+		channels[i] = Channel{ID: id, Name: names[id]}
+	}
+	return channels
+}
+
+func (dir *Directory) url() string {
+	if dir.BaseURL == "" {
+		return defaultURL
+	}
+	return dir.BaseURL
+}
+
+func (dir *Directory) ttl() time.Duration {
+	if dir.TTL == 0 {
+		return DefaultChannelTTL
+	}
+	return dir.TTL
+}
+
+// Channels returns the available channels. Channels are read from the cache
+// file if it is fresh, and discovered otherwise. If discovery fails, a stale
+// cache or the built-in channels are returned. Failing to write the cache
+// file is only logged.
+func (dir *Directory) Channels() ([]Channel, error) {
+	now := clock.OrReal(dir.Clock).Now()
+	cache, err := dir.readCache()
+	if err == nil && now.Sub(cache.Updated) < dir.ttl() {
+		return cache.Channels, nil
+	}
+	channels, err := dir.Discover()
+	if err != nil {
+		if cache != nil {
+			return cache.Channels, nil
+		}
+		return BuiltinChannels(), nil
+	}
+	if err := dir.writeCache(&channelCache{
+		Updated:  now,
+		Channels: channels,
+	}); err != nil && dir.Logger != nil {
+		dir.Logger.Warn("Failed to write channel cache",
+			logger.F("file", dir.CacheFile), logger.F("error", err))
+	}
+	return channels, nil
+}
+
+// Discover fetches the channel listing and checks which channels currently
+// expose live elements.
+func (dir *Directory) Discover() ([]Channel, error) {
+	body, err := get(clientOrDefault(dir.Client),
+		dir.url()+"/channels")
+	if err != nil {
+		return nil, err
+	}
+	var listing []channelListing
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return nil, err
+	}
+	channels := make([]Channel, 0, len(listing))
+	for _, l := range listing {
+		if l.ID == "" {
+			continue
+		}
+		name := l.Title
+		if name == "" {
+			name = l.ID
+		}
+		channels = append(channels, Channel{ID: l.ID, Name: name})
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("no channels found")
+	}
+	var wg sync.WaitGroup
+	for i := range channels {
+		wg.Add(1)
+		go func(c *Channel) {
+			defer wg.Done()
+			radio := Radio{ID: c.ID, BaseURL: dir.BaseURL,
+				Client: dir.Client}
+			playlist, err := radio.Playlist()
+			c.Checked = true
+			c.LiveElements = err == nil && len(playlist.Tracks) > 0
+		}(&channels[i])
+	}
+	wg.Wait()
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return channels, nil
+}
+
+// Radio returns a radio for channel id, if the channel exists.
+func (dir *Directory) Radio(name string, id string) (*Radio, error) {
+	channels, err := dir.Channels()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range channels {
+		if c.ID == id {
+			return &Radio{Name: name, ID: id, BaseURL: dir.BaseURL,
+				Clock: dir.Clock, Client: dir.Client}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a valid radio ID", id)
+}
+
+func (dir *Directory) readCache() (*channelCache, error) {
+	if dir.CacheFile == "" {
+		return nil, fmt.Errorf("cache disabled")
+	}
+	data, err := ioutil.ReadFile(dir.CacheFile)
+	if err != nil {
+		return nil, err
+	}
+	var cache channelCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func (dir *Directory) writeCache(cache *channelCache) error {
+	if dir.CacheFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir.CacheFile, data, 0644)
+}
+
+func clientOrDefault(c *http.Client) *http.Client {
+	if c == nil {
+		return client
+	}
+	return c
+}
+
+func get(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("request failed (%d): %s", resp.StatusCode,
+			body)
+	}
+	return body, nil
+}
@@ -0,0 +1,199 @@
+package nrk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
+)
+
+type channelServer struct {
+	*httptest.Server
+	requests int
+	fail     bool
+}
+
+func newChannelServer() *channelServer {
+	s := &channelServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channels", func(w http.ResponseWriter,
+		r *http.Request) {
+		s.requests++
+		if s.fail {
+			http.Error(w, "gopher says no", 500)
+			return
+		}
+		fmt.Fprint(w, channelsResponse)
+	})
+	mux.HandleFunc("/channels/p3/liveelements/now",
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, testResponse)
+		})
+	mux.HandleFunc("/channels/p1_ostlandssendingen/liveelements/now",
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "[]")
+		})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func newTestDirectory(t *testing.T, url string) (*Directory, *clock.Fake,
+	func()) {
+	f, err := ioutil.TempFile("", "nrk_channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	clock := clock.NewFake(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	dir := &Directory{
+		CacheFile: f.Name(),
+		TTL:       time.Hour,
+		BaseURL:   url,
+		Clock:     clock,
+	}
+	return dir, clock, func() { os.Remove(f.Name()) }
+}
+
+func TestDiscover(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	dir := Directory{BaseURL: server.URL}
+
+	channels, err := dir.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Channel{
+		{ID: "mp3", Name: "NRK mP3", Checked: true},
+		{ID: "p1_ostlandssendingen", Name: "NRK P1 Østlandssendingen",
+			Checked: true},
+		{ID: "p3", Name: "NRK P3", Checked: true, LiveElements: true},
+	}
+	if len(channels) != len(expected) {
+		t.Fatalf("Expected %d channels, got %d", len(expected),
+			len(channels))
+	}
+	for i := range expected {
+		if channels[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], channels[i])
+		}
+	}
+}
+
+func TestChannelsCache(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	dir, clock, cleanup := newTestDirectory(t, server.URL)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		channels, err := dir.Channels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(channels) != 3 {
+			t.Fatalf("Expected 3 channels, got %d", len(channels))
+		}
+	}
+	if server.requests != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requests)
+	}
+
+	// Cache expires
+	clock.Advance(time.Hour)
+	if _, err := dir.Channels(); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 2 {
+		t.Fatalf("Expected 2 requests, got %d", server.requests)
+	}
+
+	// Stale cache is used if discovery fails
+	clock.Advance(time.Hour)
+	server.fail = true
+	channels, err := dir.Channels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 3 {
+		t.Fatalf("Expected 3 channels, got %d", len(channels))
+	}
+}
+
+func TestChannelsFallback(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	server.fail = true
+	dir, _, cleanup := newTestDirectory(t, server.URL)
+	defer cleanup()
+
+	channels, err := dir.Channels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != len(ids) {
+		t.Fatalf("Expected %d channels, got %d", len(ids), len(channels))
+	}
+	if channels[0].ID != "p1pluss" || channels[0].Name != "NRK P1+" ||
+		channels[0].Checked {
+		t.Fatalf("Unexpected channel: %+v", channels[0])
+	}
+}
+
+func TestChannelsUnwritableCache(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	var buf bytes.Buffer
+	dir := Directory{
+		CacheFile: "/non-existent/channels.json",
+		BaseURL:   server.URL,
+		Logger:    logger.New(&buf, logger.Text, logger.Info),
+	}
+
+	channels, err := dir.Channels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 3 || !channels[2].LiveElements {
+		t.Fatalf("Expected discovered channels, got %+v", channels)
+	}
+	if !strings.Contains(buf.String(), "Failed to write channel cache") {
+		t.Fatalf("Expected write error to be logged, got %q",
+			buf.String())
+	}
+}
+
+func TestDirectoryRadio(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	dir, _, cleanup := newTestDirectory(t, server.URL)
+	defer cleanup()
+
+	radio, err := dir.Radio("NRK P1", "p1_ostlandssendingen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if radio.ID != "p1_ostlandssendingen" || radio.BaseURL != server.URL {
+		t.Fatalf("Unexpected radio: %+v", radio)
+	}
+	if _, err := dir.Radio("NRK P1", "p1"); err == nil {
+		t.Fatal("Expected error for unknown channel")
+	}
+}
+
+const channelsResponse string = `
+[
+  {"channelId": "p3", "title": "NRK P3"},
+  {"channelId": "p1_ostlandssendingen", "title": "NRK P1 Østlandssendingen"},
+  {"channelId": "mp3", "title": "NRK mP3"},
+  {"channelId": "", "title": "Broken"}
+]`
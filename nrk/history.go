@@ -0,0 +1,68 @@
+package nrk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// HistoryURL returns the URL of the elements played between from and to.
+func (radio *Radio) HistoryURL(from, to time.Time) string {
+	base := radio.BaseURL
+	if base == "" {
+		base = defaultURL
+	}
+	params := url.Values{
+		"from": {from.UTC().Format(time.RFC3339)},
+		"to":   {to.UTC().Format(time.RFC3339)},
+	}
+	return fmt.Sprintf("%s/channels/%s/liveelements?%s", base, radio.ID,
+		params.Encode())
+}
+
+// History returns the elements played between from and to, in broadcast
+// order.
+func (radio *Radio) History(from, to time.Time) ([]Track, error) {
+	body, err := get(radio.httpClient(), radio.HistoryURL(from, to))
+	if err != nil {
+		return nil, err
+	}
+	var tracks []Track
+	if err := json.Unmarshal(body, &tracks); err != nil {
+		return nil, err
+	}
+	return Between(tracks, from, to), nil
+}
+
+// Between returns the tracks starting between from (inclusive) and to
+// (exclusive), sorted by start time. Duplicates and tracks without a valid
+// start time are dropped.
+func Between(tracks []Track, from, to time.Time) []Track {
+	type played struct {
+		track Track
+		start time.Time
+	}
+	seen := make(map[Track]bool)
+	matched := []played{}
+	for _, t := range tracks {
+		start, err := t.StartTime()
+		if err != nil || start.Before(from) || !start.Before(to) {
+			continue
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		matched = append(matched, played{track: t, start: start})
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].start.Before(matched[j].start)
+	})
+	between := make([]Track, len(matched))
+	for i, p := range matched {
+		between[i] = p.track
+	}
+	return between
+}
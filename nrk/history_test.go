@@ -0,0 +1,69 @@
+package nrk
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func historyTrack(title string, start time.Time) Track {
+	return Track{
+		Track:      title,
+		Artist:     "Bob Dylan",
+		Type:       "Music",
+		StartTime_: fmt.Sprintf("/Date(%d+0000)/", start.Unix()*1000),
+		Duration_:  "PT4M",
+	}
+}
+
+func TestBetween(t *testing.T) {
+	from := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	a := historyTrack("A", from.Add(-time.Minute))
+	b := historyTrack("B", from)
+	c := historyTrack("C", from.Add(30*time.Minute))
+	d := historyTrack("D", to)
+	invalid := Track{Track: "E", StartTime_: "yesterday"}
+
+	tracks := Between([]Track{d, c, invalid, b, a, c}, from, to)
+	if len(tracks) != 2 || tracks[0] != b || tracks[1] != c {
+		t.Fatalf("Expected [%v %v], got %v", b, c, tracks)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	from := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/channels/p3/liveelements" {
+				http.NotFound(w, r)
+				return
+			}
+			query = r.URL.RawQuery
+			fmt.Fprintf(w, `[{"title": "B", "type": "Music",
+"startTime": "/Date(%d+0000)/", "duration": "PT4M"},
+{"title": "A", "type": "Music",
+"startTime": "/Date(%d+0000)/", "duration": "PT4M"}]`,
+				from.Add(10*time.Minute).Unix()*1000,
+				from.Unix()*1000)
+		}))
+	defer server.Close()
+
+	radio := Radio{ID: "p3", BaseURL: server.URL}
+	tracks, err := radio.History(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "from=2015-01-01T08%3A00%3A00Z&to=2015-01-01T09%3A00%3A00Z"
+	if query != expected {
+		t.Fatalf("Expected query %s, got %s", expected, query)
+	}
+	if len(tracks) != 2 || tracks[0].Track != "A" ||
+		tracks[1].Track != "B" {
+		t.Fatalf("Expected tracks in broadcast order, got %v", tracks)
+	}
+}
@@ -0,0 +1,151 @@
+package nrk
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nominal lengths used for the calendar dependent units of a duration
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+	year  = 365 * day
+)
+
+var datePattern = regexp.MustCompile(
+	`^/Date\((-?\d+)(?:([+-])(\d{2})(\d{2}))?\)/$`)
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseDuration parses an ISO 8601 duration, such as PT3M20.5S or P1DT2H.
+// Years and months are interpreted as 365 and 30 days.
+func parseDuration(raw string) (time.Duration, error) {
+	fail := func(reason string) (time.Duration, error) {
+		return 0, fmt.Errorf("invalid duration %q: %s", raw, reason)
+	}
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") {
+		return fail("missing P designator")
+	}
+	s = s[1:]
+	if s == "" || strings.HasSuffix(s, "T") {
+		return fail("no components")
+	}
+	units := map[byte]time.Duration{
+		'Y': year, 'M': month, 'W': week, 'D': day,
+	}
+	order := "YMWD"
+	inTime := false
+	fraction := false
+	total := 0.0
+	for len(s) > 0 {
+		if s[0] == 'T' {
+			if inTime {
+				return fail("unexpected T")
+			}
+			inTime = true
+			units = map[byte]time.Duration{
+				'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+			}
+			order = "HMS"
+			s = s[1:]
+			continue
+		}
+		i := strings.IndexFunc(s, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.' && r != ','
+		})
+		if i == 0 {
+			return fail(fmt.Sprintf("expected number at %q", s))
+		}
+		if i < 0 {
+			return fail(fmt.Sprintf("missing unit after %q", s))
+		}
+		if fraction {
+			return fail("only the smallest component may be " +
+				"fractional")
+		}
+		number := strings.Replace(s[:i], ",", ".", 1)
+		if strings.HasPrefix(number, ".") ||
+			strings.HasSuffix(number, ".") {
+			return fail(fmt.Sprintf("invalid number %q", s[:i]))
+		}
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return fail(fmt.Sprintf("invalid number %q", s[:i]))
+		}
+		fraction = strings.Contains(number, ".")
+		pos := strings.IndexByte(order, s[i])
+		if pos < 0 {
+			return fail(fmt.Sprintf("unexpected unit %q", s[i]))
+		}
+		total += value * float64(units[s[i]])
+		if total >= math.MaxInt64 {
+			return fail("out of range")
+		}
+		order = order[pos+1:]
+		s = s[i+1:]
+	}
+	return time.Duration(math.Round(sign * total)), nil
+}
+
+// parseTime parses a timestamp, either in the /Date(milliseconds+hhmm)/
+// format or as an ISO 8601 timestamp. The location of the returned time is
+// the UTC offset of the timestamp.
+func parseTime(raw string) (time.Time, error) {
+	s := strings.TrimSpace(raw)
+	if strings.HasPrefix(s, "/Date(") {
+		return parseDate(raw, s)
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", raw)
+}
+
+func parseDate(raw, s string) (time.Time, error) {
+	matches := datePattern.FindStringSubmatch(s)
+	if matches == nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", raw)
+	}
+	ms, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: %s", raw,
+			err)
+	}
+	t := time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+	offset := 0
+	if matches[2] != "" {
+		// No zone is offset by more than 14 hours
+		hours, err := strconv.Atoi(matches[3])
+		if err != nil || hours > 14 {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: "+
+				"invalid offset", raw)
+		}
+		minutes, err := strconv.Atoi(matches[4])
+		if err != nil || minutes > 59 {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: "+
+				"invalid offset", raw)
+		}
+		offset = hours*3600 + minutes*60
+		if matches[2] == "-" {
+			offset = -offset
+		}
+	}
+	return t.In(time.FixedZone("", offset)), nil
+}
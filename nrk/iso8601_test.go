@@ -0,0 +1,210 @@
+package nrk
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out time.Duration
+	}{
+		{"PT6M10S", 6*time.Minute + 10*time.Second},
+		{"PT3M20.5S", 3*time.Minute + 20500*time.Millisecond},
+		{"PT3M20,5S", 3*time.Minute + 20500*time.Millisecond},
+		{"PT1H30M", 90 * time.Minute},
+		{"PT0S", 0},
+		{"PT1.5H", 90 * time.Minute},
+		{"P1D", 24 * time.Hour},
+		{"P1DT2H", 26 * time.Hour},
+		{"P2W", 14 * 24 * time.Hour},
+		{"P1M", 30 * 24 * time.Hour},
+		{"P1Y", 365 * 24 * time.Hour},
+		{"pt4m", 4 * time.Minute},
+		{"-PT30S", -30 * time.Second},
+		{" PT1S ", time.Second},
+	}
+	for _, tt := range tests {
+		d, err := parseDuration(tt.in)
+		if err != nil {
+			t.Errorf("parseDuration(%q): %s", tt.in, err)
+			continue
+		}
+		if d != tt.out {
+			t.Errorf("parseDuration(%q) = %s, want %s", tt.in, d,
+				tt.out)
+		}
+	}
+}
+
+func TestParseDurationErrors(t *testing.T) {
+	var tests = []string{
+		"",
+		"P",
+		"PT",
+		"P1DT",
+		"6M10S",
+		"PT6X",
+		"PT10",
+		"PTS",
+		"PT.5S",
+		"PT5.S",
+		"PT1.5M10S",
+		"PT10S5M",
+		"P1DT1HT2M",
+		"PT1S1S",
+		"P1H",
+		"PT1D",
+		"P99999999999Y",
+	}
+	for _, in := range tests {
+		_, err := parseDuration(in)
+		if err == nil {
+			t.Errorf("parseDuration(%q): expected error", in)
+			continue
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", in)) {
+			t.Errorf("parseDuration(%q): error %q does not include "+
+				"raw value", in, err)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	var tests = []struct {
+		in     string
+		out    time.Time
+		offset int
+	}{
+		{"/Date(1405971945000+0200)/", time.Unix(1405971945, 0),
+			2 * 60 * 60},
+		{"/Date(1405971945000-0130)/", time.Unix(1405971945, 0),
+			-90 * 60},
+		{"/Date(1405971945500)/",
+			time.Unix(1405971945, 500*int64(time.Millisecond)), 0},
+		{"/Date(-1500)/",
+			time.Unix(-2, 500*int64(time.Millisecond)), 0},
+		{"2014-07-21T21:45:45+02:00", time.Unix(1405971945, 0),
+			2 * 60 * 60},
+		{"2014-07-21T19:45:45.25Z",
+			time.Unix(1405971945, 250*int64(time.Millisecond)), 0},
+		{"2014-07-21T21:45:45+0200", time.Unix(1405971945, 0),
+			2 * 60 * 60},
+		{"2014-07-21T19:45:45", time.Unix(1405971945, 0), 0},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.in)
+		if err != nil {
+			t.Errorf("parseTime(%q): %s", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.out) {
+			t.Errorf("parseTime(%q) = %s, want %s", tt.in, got,
+				tt.out)
+		}
+		if _, offset := got.Zone(); offset != tt.offset {
+			t.Errorf("parseTime(%q): offset %d, want %d", tt.in,
+				offset, tt.offset)
+		}
+	}
+}
+
+func TestParseTimeErrors(t *testing.T) {
+	var tests = []string{
+		"",
+		"yesterday",
+		"/Date()/",
+		"/Date(1405971945000+02)/",
+		"/Date(1405971945000+0260)/",
+		"/Date(0+7000)/",
+		"/Date(99999999999999999999)/",
+		"2014-07-21 19:45:45",
+	}
+	for _, in := range tests {
+		_, err := parseTime(in)
+		if err == nil {
+			t.Errorf("parseTime(%q): expected error", in)
+			continue
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", in)) {
+			t.Errorf("parseTime(%q): error %q does not include "+
+				"raw value", in, err)
+		}
+	}
+}
+
+func FuzzParseDuration(f *testing.F) {
+	for _, seed := range []string{"PT6M10S", "PT3M20.5S", "P1DT2H",
+		"-P2W", "PT", "P1Y2M3DT4H5M6.7S"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		d, err := parseDuration(raw)
+		if err != nil {
+			quoted := fmt.Sprintf("%q", raw)
+			if !strings.Contains(err.Error(), quoted) {
+				t.Fatalf("error %q does not include %s", err,
+					quoted)
+			}
+			return
+		}
+		// Any accepted duration must survive a round-trip through
+		// its own seconds representation, within float precision
+		again, err := parseDuration(formatDuration(d))
+		if err != nil {
+			t.Fatalf("round-trip of %q (%s): %s", raw, d, err)
+		}
+		diff := math.Abs(float64(again - d))
+		if diff > math.Abs(float64(d))*1e-12+1 {
+			t.Fatalf("round-trip of %q: %s != %s", raw, again, d)
+		}
+	})
+}
+
+func FuzzParseTime(f *testing.F) {
+	for _, seed := range []string{"/Date(1405971945000+0200)/",
+		"/Date(-1)/", "2014-07-21T21:45:45+02:00",
+		"2014-07-21T19:45:45", "/Date(0+7000)/"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		got, err := parseTime(raw)
+		if err != nil {
+			quoted := fmt.Sprintf("%q", raw)
+			if !strings.Contains(err.Error(), quoted) {
+				t.Fatalf("error %q does not include %s", err,
+					quoted)
+			}
+			return
+		}
+		again, err := parseTime(got.Format(time.RFC3339Nano))
+		if err != nil {
+			// Years outside 0-9999 cannot be formatted as
+			// RFC 3339
+			if got.Year() < 0 || got.Year() > 9999 {
+				return
+			}
+			t.Fatalf("round-trip of %q (%s): %s", raw, got, err)
+		}
+		if !again.Equal(got) {
+			t.Fatalf("round-trip of %q: %s != %s", raw, again,
+				got)
+		}
+	})
+}
+
+// formatDuration formats d as an ISO 8601 duration in seconds
+func formatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	return fmt.Sprintf("%sPT%sS", sign,
+		strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+}
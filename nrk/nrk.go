@@ -3,26 +3,27 @@ package nrk
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"net/http"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mitchellh/colorstring"
+	"github.com/mpolden/nrk-spotify/clock"
 	"github.com/mreiferson/go-httpclient"
 )
 
-var transport = &httpclient.Transport{
+// Transport is the transport of the default client, which is used if no
+// client is set.
+var Transport = &httpclient.Transport{
 	ConnectTimeout:        2 * time.Second,
 	RequestTimeout:        10 * time.Second,
 	ResponseHeaderTimeout: 5 * time.Second,
 }
 
-var client = &http.Client{Transport: transport}
+var client = &http.Client{Transport: Transport}
 
+// ids are the built-in channels, used when channels cannot be discovered.
 var ids = [...]string{
 	"p1pluss",
 	"p2",
@@ -42,13 +43,16 @@ var ids = [...]string{
 const defaultURL string = "http://v7.psapi.nrk.no"
 
 type Radio struct {
-	Name string
-	ID   string
-	url  string
+	Name    string
+	ID      string
+	BaseURL string
+	Clock   clock.Clock
+	Client  *http.Client
 }
 
 type Playlist struct {
 	Tracks []Track
+	Clock  clock.Clock
 }
 
 type Track struct {
@@ -57,6 +61,9 @@ type Track struct {
 	Type       string `json:"type"`
 	StartTime_ string `json:"startTime"`
 	Duration_  string `json:"duration"`
+	// Programme is the title of the programme the track was played in, if
+	// known
+	Programme string `json:"programme,omitempty"`
 }
 
 type Position struct {
@@ -64,29 +71,22 @@ type Position struct {
 	Duration time.Duration
 }
 
-func IDs() [13]string {
-	return ids
-}
-
-func New(name string, id string) (*Radio, error) {
-	radio := Radio{
-		Name: name,
-		ID:   id,
-	}
-	if !radio.isValidID() {
-		return nil, fmt.Errorf("%s is not a valid radio ID", radio.ID)
-	}
-	return &radio, nil
-}
-
 func (radio *Radio) URL() string {
-	url := radio.url
+	url := radio.BaseURL
 	if url == "" {
 		url = defaultURL
 	}
 	return url + fmt.Sprintf("/channels/%s/liveelements/now", radio.ID)
 }
 
+func (radio *Radio) httpClient() *http.Client {
+	return clientOrDefault(radio.Client)
+}
+
+func (radio *Radio) String() string {
+	return radio.Name
+}
+
 func (track *Track) ArtistName() string {
 	words := strings.Split(track.Artist, " + ")
 	if len(words) > 0 {
@@ -129,27 +129,14 @@ func (track *Track) IsMusic() bool {
 }
 
 func (track *Track) StartTime() (time.Time, error) {
-	re := regexp.MustCompile("^/Date\\((\\d+)\\+\\d+\\)/$")
-	matches := re.FindAllStringSubmatch(track.StartTime_, 2)
-	if len(matches) > 0 && len(matches[0]) == 2 {
-		timestamp, err := strconv.ParseInt(matches[0][1], 10, 0)
-		if err != nil {
-			return time.Time{}, err
-		}
-		return time.Unix(timestamp/1000, 0), nil
-	}
-	return time.Time{}, fmt.Errorf("failed to parse start time")
+	return parseTime(track.StartTime_)
 }
 
 func (track *Track) Duration() (time.Duration, error) {
-	duration := strings.ToLower(track.Duration_)
-	if strings.HasPrefix(duration, "pt") {
-		duration = duration[2:]
-	}
-	return time.ParseDuration(duration)
+	return parseDuration(track.Duration_)
 }
 
-func (track *Track) Position() (Position, error) {
+func (track *Track) PositionAt(now time.Time) (Position, error) {
 	startTime, err := track.StartTime()
 	if err != nil {
 		return Position{}, err
@@ -158,7 +145,7 @@ func (track *Track) Position() (Position, error) {
 	if err != nil {
 		return Position{}, err
 	}
-	position := time.Now().Truncate(1 * time.Second).Sub(startTime)
+	position := now.Truncate(1 * time.Second).Sub(startTime)
 	// If position is longer than duration, just assume we're at the end
 	// This can happen if the API returns a incorrect startTime, or if the
 	// system time is incorrect
@@ -226,13 +213,17 @@ func (playlist *Playlist) NextSync(tracks []Track) (time.Duration, error) {
 	return total, nil
 }
 
+func (playlist *Playlist) Position(track *Track) (Position, error) {
+	return track.PositionAt(clock.OrReal(playlist.Clock).Now())
+}
+
 func (playlist *Playlist) Remaining(track *Track) (time.Duration, error) {
 	current, err := playlist.Current()
 	if err != nil {
 		return time.Duration(0), err
 	}
 	if *current == *track {
-		position, err := current.Position()
+		position, err := playlist.Position(current)
 		if err != nil {
 			return time.Duration(0), err
 		}
@@ -246,16 +237,7 @@ func (playlist *Playlist) Remaining(track *Track) (time.Duration, error) {
 }
 
 func (radio *Radio) Playlist() (*Playlist, error) {
-	req, err := http.NewRequest("GET", radio.URL(), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := get(radio.httpClient(), radio.URL())
 	if err != nil {
 		return nil, err
 	}
@@ -263,14 +245,5 @@ func (radio *Radio) Playlist() (*Playlist, error) {
 	if err := json.Unmarshal(body, &tracks); err != nil {
 		return nil, err
 	}
-	return &Playlist{Tracks: tracks}, nil
-}
-
-func (radio *Radio) isValidID() bool {
-	for _, id := range ids {
-		if id == radio.ID {
-			return true
-		}
-	}
-	return false
+	return &Playlist{Tracks: tracks, Clock: radio.Clock}, nil
 }
@@ -6,6 +6,8 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
 )
 
 func testTrack() Track {
@@ -25,9 +27,12 @@ func TestStartTime(t *testing.T) {
 		t.Fatalf("Failed to parse start time: %s", err)
 	}
 	expected := time.Unix(1405971945, 0)
-	if startTime != expected {
+	if !startTime.Equal(expected) {
 		t.Fatalf("Expected %s, got %s", expected, startTime)
 	}
+	if _, offset := startTime.Zone(); offset != 2*60*60 {
+		t.Fatalf("Expected offset +0200, got %d", offset)
+	}
 }
 
 func TestDuration(t *testing.T) {
@@ -74,7 +79,7 @@ func TestPosition(t *testing.T) {
 	thirtySecsAgo := time.Now().Unix() - 30
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/", thirtySecsAgo)
 
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to get position: %s", err)
 	}
@@ -89,7 +94,7 @@ func TestPositionString(t *testing.T) {
 	thirtySecsAgo := time.Now().Unix() - 30
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/", thirtySecsAgo)
 
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to parse position: %s", err)
 	}
@@ -106,7 +111,7 @@ func TestPositionSymbol(t *testing.T) {
 	thirtySecsAgo := time.Now().Unix() - 30
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/", thirtySecsAgo)
 
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to parse position: %s", err)
 	}
@@ -131,7 +136,7 @@ func TestPositionSymbolRatioGreaterThanOne(t *testing.T) {
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/",
 		time.Now().Unix()-371)
 
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to parse position: %s", err)
 	}
@@ -152,7 +157,7 @@ func TestPositionLongerThanDuration(t *testing.T) {
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/",
 		time.Now().Unix()-371)
 
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to parse position: %s", err)
 	}
@@ -166,7 +171,7 @@ func TestPositionNegative(t *testing.T) {
 	track := testTrack()
 	track.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/",
 		time.Now().Unix()+370)
-	position, err := track.Position()
+	position, err := track.PositionAt(time.Now())
 	if err != nil {
 		t.Fatalf("Failed to parse position: %s", err)
 	}
@@ -175,11 +180,33 @@ func TestPositionNegative(t *testing.T) {
 	}
 }
 
+func TestPlaylistPosition(t *testing.T) {
+	track := testTrack()
+	startTime := time.Unix(1405971945, 0)
+	clock := clock.NewFake(startTime.Add(90 * time.Second))
+	playlist := Playlist{Clock: clock}
+
+	position, err := playlist.Position(&track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "01:30/06:10"; position.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, position.String())
+	}
+	clock.Advance(time.Hour)
+	position, err = playlist.Position(&track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "06:10/06:10"; position.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, position.String())
+	}
+}
+
 func TestNextSync(t *testing.T) {
-	currentTrack := testTrack()
 	// 42 seconds into current track
-	currentTrack.StartTime_ = fmt.Sprintf("/Date(%d000+0200)/",
-		time.Now().Unix()-42)
+	currentTrack := testTrack()
+	startTime := time.Unix(1405971945, 0)
 
 	// Next track is 3m 37s long
 	nextTrack := testTrack()
@@ -187,6 +214,7 @@ func TestNextSync(t *testing.T) {
 
 	playlist := Playlist{
 		Tracks: []Track{Track{}, currentTrack, nextTrack},
+		Clock:  clock.NewFake(startTime.Add(42 * time.Second)),
 	}
 
 	tracks := []Track{currentTrack, nextTrack}
@@ -317,7 +345,7 @@ func newTestServer(path string, body string) *httptest.Server {
 func TestPlaylist(t *testing.T) {
 	server := newTestServer("/", testResponse)
 	defer server.Close()
-	r := Radio{Name: "P3 Pyro", ID: "pyro", url: server.URL}
+	r := Radio{Name: "P3 Pyro", ID: "pyro", BaseURL: server.URL}
 	playlist, err := r.Playlist()
 	if err != nil {
 		t.Fatal(err)
@@ -343,7 +371,7 @@ func TestPlaylist(t *testing.T) {
 func TestPlaylistInvalidResponse(t *testing.T) {
 	server := newTestServer("/", "gopher says: no JSON for you!")
 	defer server.Close()
-	r := Radio{Name: "P3 Pyro", ID: "pyro", url: server.URL}
+	r := Radio{Name: "P3 Pyro", ID: "pyro", BaseURL: server.URL}
 	_, err := r.Playlist()
 	if err == nil {
 		t.Fatal("Expected error for invalid JSON response")
@@ -0,0 +1,402 @@
+package nrktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+type Element struct {
+	Title       string
+	Description string
+	Type        string
+	Start       time.Time
+	Duration    time.Duration
+	// Raw is served verbatim instead of the element, if set
+	Raw string
+}
+
+type Script struct {
+	elements   []Element
+	programmes []Programme
+	end        time.Time
+}
+
+type Programme struct {
+	Title string
+	Start time.Time
+	End   time.Time
+}
+
+type Server struct {
+	URL string
+
+	mu        sync.Mutex
+	server    *httptest.Server
+	clock     clock.Clock
+	scripts   map[string][]Element
+	schedules map[string][]Programme
+}
+
+type liveElement struct {
+	Title            string  `json:"title"`
+	Description      string  `json:"description"`
+	ProgramId        string  `json:"programId"`
+	ChannelId        string  `json:"channelId"`
+	StartTime        string  `json:"startTime"`
+	Duration         string  `json:"duration"`
+	Type             string  `json:"type"`
+	ImageUrl         *string `json:"imageUrl"`
+	ProgramTitle     *string `json:"programTitle"`
+	RelativeTimeType string  `json:"relativeTimeType"`
+}
+
+type scheduleEntry struct {
+	ProgramId string `json:"programId"`
+	Title     string `json:"title"`
+	StartTime string `json:"startTime"`
+	Duration  string `json:"duration"`
+}
+
+func (e *Element) End() time.Time {
+	return e.Start.Add(e.Duration)
+}
+
+// NewScript returns a script for a programme starting at start.
+func NewScript(start time.Time) *Script {
+	return &Script{end: start}
+}
+
+func (s *Script) add(e Element) *Script {
+	e.Start = s.end
+	s.elements = append(s.elements, e)
+	s.end = e.End()
+	return s
+}
+
+func (s *Script) Track(artist, title string, duration time.Duration) *Script {
+	return s.add(Element{
+		Title:       title,
+		Description: artist,
+		Type:        "Music",
+		Duration:    duration,
+	})
+}
+
+func (s *Script) Talk(title string, duration time.Duration) *Script {
+	return s.add(Element{
+		Title:    title,
+		Type:     "Program",
+		Duration: duration,
+	})
+}
+
+// Gap adds a period where nothing is on air.
+func (s *Script) Gap(duration time.Duration) *Script {
+	s.end = s.end.Add(duration)
+	return s
+}
+
+// Malformed adds an element which is served as raw.
+func (s *Script) Malformed(raw string, duration time.Duration) *Script {
+	return s.add(Element{Raw: raw, Duration: duration})
+}
+
+// Programme starts a programme, which lasts until the next programme or the
+// end of the script.
+func (s *Script) Programme(title string) *Script {
+	s.programmes = append(s.programmes, Programme{
+		Title: title,
+		Start: s.end,
+	})
+	return s
+}
+
+func (s *Script) End() time.Time {
+	return s.end
+}
+
+// Programmes returns the schedule of the script.
+func (s *Script) Programmes() []Programme {
+	programmes := make([]Programme, len(s.programmes))
+	for i, p := range s.programmes {
+		p.End = s.end
+		if i+1 < len(s.programmes) {
+			p.End = s.programmes[i+1].Start
+		}
+		programmes[i] = p
+	}
+	return programmes
+}
+
+func (s *Script) Elements() []Element {
+	elements := make([]Element, len(s.elements))
+	copy(elements, s.elements)
+	return elements
+}
+
+// Day returns a script for a full day of radio starting at start. Every
+// hour starts with a talk segment, followed by music, and the day contains
+// a gap and a malformed element.
+func Day(start time.Time) *Script {
+	s := NewScript(start)
+	durations := []time.Duration{
+		3*time.Minute + 20*time.Second,
+		4*time.Minute + 5*time.Second,
+		2*time.Minute + 48*time.Second,
+		5*time.Minute + 12*time.Second,
+	}
+	for hour := 0; hour < 24; hour++ {
+		s.Talk(fmt.Sprintf("News %02d:00", hour), 5*time.Minute)
+		for n := 0; s.End().Before(start.Add(
+			time.Duration(hour+1)*time.Hour - 6*time.Minute)); n++ {
+			s.Track(fmt.Sprintf("Artist %d", n%7),
+				fmt.Sprintf("Track %d-%d", hour, n),
+				durations[n%len(durations)])
+		}
+		switch hour {
+		case 3:
+			s.Malformed(`{"title": 42, "startTime": "yesterday"}`,
+				3*time.Minute)
+		case 4:
+			s.Gap(2 * time.Minute)
+		}
+		if remaining := start.Add(time.Duration(hour+1) *
+			time.Hour).Sub(s.End()); remaining > 0 {
+			s.Talk("Jingle", remaining)
+		}
+	}
+	return s
+}
+
+// NewServer starts a new fake server which plays scripts according to clock.
+// The caller should call Close when finished.
+func NewServer(clock clock.Clock) *Server {
+	s := &Server{
+		clock:     clock,
+		scripts:   make(map[string][]Element),
+		schedules: make(map[string][]Programme),
+	}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Radio returns a radio configured to use this server.
+func (s *Server) Radio(name, id string) *nrk.Radio {
+	return &nrk.Radio{Name: name, ID: id, BaseURL: s.URL, Clock: s.clock}
+}
+
+// Play sets the script played by channel id.
+func (s *Server) Play(id string, script *Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[id] = script.Elements()
+	s.schedules[id] = script.Programmes()
+}
+
+// LiveElements returns the elements served for channel id at the current
+// time: the previous, current and next element. Only two elements are
+// returned when nothing is currently on air.
+func (s *Server) LiveElements(id string) []Element {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return liveElements(s.scripts[id], s.clock.Now())
+}
+
+func liveElements(elements []Element, now time.Time) []Element {
+	var previous, current, next *Element
+	for i := range elements {
+		e := &elements[i]
+		switch {
+		case !e.End().After(now):
+			previous = e
+		case !e.Start.After(now):
+			current = e
+		case next == nil:
+			next = e
+		}
+	}
+	live := []Element{}
+	for _, e := range []*Element{previous, current, next} {
+		if e != nil {
+			live = append(live, *e)
+		}
+	}
+	return live
+}
+
+func formatTime(t time.Time) string {
+	_, offset := t.Zone()
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("/Date(%d%s%02d%02d)/", t.UnixNano()/1e6, sign,
+		offset/3600, offset%3600/60)
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	sec := int(d.Seconds()) % 60
+	s := "PT"
+	if h > 0 {
+		s += fmt.Sprintf("%dH", h)
+	}
+	if m > 0 {
+		s += fmt.Sprintf("%dM", m)
+	}
+	if sec > 0 || (h == 0 && m == 0) {
+		s += fmt.Sprintf("%dS", sec)
+	}
+	return s
+}
+
+func relativeTime(e *Element, now time.Time) string {
+	if !e.End().After(now) {
+		return "Past"
+	}
+	if e.Start.After(now) {
+		return "Future"
+	}
+	return "Present"
+}
+
+// History returns the elements which started on channel id between from
+// and to, and which have started at the current time.
+func (s *Server) History(id string, from, to time.Time) []Element {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return history(s.scripts[id], s.clock.Now(), from, to)
+}
+
+func history(elements []Element, now, from, to time.Time) []Element {
+	played := []Element{}
+	for _, e := range elements {
+		if e.Start.Before(from) || !e.Start.Before(to) ||
+			e.Start.After(now) {
+			continue
+		}
+		played = append(played, e)
+	}
+	return played
+}
+
+func parseWindow(r *http.Request) (time.Time, time.Time, error) {
+	from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return from, to, nil
+}
+
+func (s *Server) serveSchedule(w http.ResponseWriter, r *http.Request,
+	id string) {
+	from, to, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	programmes, ok := s.schedules[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	entries := []scheduleEntry{}
+	for _, p := range programmes {
+		if !p.End.After(from) || !p.Start.Before(to) {
+			continue
+		}
+		entries = append(entries, scheduleEntry{
+			ProgramId: fmt.Sprintf("prog%d", p.Start.Unix()),
+			Title:     p.Title,
+			StartTime: formatTime(p.Start),
+			Duration:  formatDuration(p.End.Sub(p.Start)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// ServeHTTP serves the live elements at /channels/{id}/liveelements/now, the
+// elements played in a time window at
+// /channels/{id}/liveelements?from={time}&to={time} and the programmes in a
+// time window at /channels/{id}/schedule?from={time}&to={time}.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 3 && parts[0] == "channels" &&
+		parts[2] == "schedule" {
+		s.serveSchedule(w, r, parts[1])
+		return
+	}
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "channels" ||
+		parts[2] != "liveelements" ||
+		(len(parts) == 4 && parts[3] != "now") {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[1]
+	s.mu.Lock()
+	script, ok := s.scripts[id]
+	s.mu.Unlock()
+	now := s.clock.Now()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var elements []Element
+	if len(parts) == 4 {
+		elements = liveElements(script, now)
+	} else {
+		from, to, err := parseWindow(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		elements = history(script, now, from, to)
+	}
+	raw := make([]json.RawMessage, len(elements))
+	for i, e := range elements {
+		if e.Raw != "" {
+			raw[i] = json.RawMessage(e.Raw)
+			continue
+		}
+		data, err := json.Marshal(liveElement{
+			Title:            e.Title,
+			Description:      e.Description,
+			ProgramId:        "unknown",
+			ChannelId:        id,
+			StartTime:        formatTime(e.Start),
+			Duration:         formatDuration(e.Duration),
+			Type:             e.Type,
+			RelativeTimeType: relativeTime(&e, now),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		raw[i] = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(raw)
+}
@@ -0,0 +1,199 @@
+package nrktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+)
+
+var start = time.Date(2015, 1, 1, 0, 0, 0, 0,
+	time.FixedZone("CET", 3600))
+
+func TestScript(t *testing.T) {
+	script := NewScript(start).
+		Track("Bob Dylan", "Like a Rolling Stone", 6*time.Minute).
+		Gap(time.Minute).
+		Talk("News", 5*time.Minute)
+	elements := script.Elements()
+	if len(elements) != 2 {
+		t.Fatalf("Expected 2 elements, got %d", len(elements))
+	}
+	if expected := start.Add(7 * time.Minute); elements[1].Start != expected {
+		t.Fatalf("Expected %s, got %s", expected, elements[1].Start)
+	}
+	if expected := start.Add(12 * time.Minute); script.End() != expected {
+		t.Fatalf("Expected %s, got %s", expected, script.End())
+	}
+}
+
+func TestDay(t *testing.T) {
+	script := Day(start)
+	if expected := start.Add(24 * time.Hour); script.End() != expected {
+		t.Fatalf("Expected %s, got %s", expected, script.End())
+	}
+	var music, talk, malformed int
+	for _, e := range script.Elements() {
+		switch {
+		case e.Raw != "":
+			malformed++
+		case e.Type == "Music":
+			music++
+		default:
+			talk++
+		}
+	}
+	if music == 0 || talk < 24 || malformed != 1 {
+		t.Fatalf("Unexpected day: music=%d talk=%d malformed=%d",
+			music, talk, malformed)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	var tests = []struct {
+		in  time.Duration
+		out string
+	}{
+		{0, "PT0S"},
+		{10 * time.Second, "PT10S"},
+		{6 * time.Minute, "PT6M"},
+		{6*time.Minute + 10*time.Second, "PT6M10S"},
+		{time.Hour + 5*time.Second, "PT1H5S"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.in); got != tt.out {
+			t.Errorf("Expected %s, got %s", tt.out, got)
+		}
+	}
+	expected := "/Date(1420066800000+0100)/"
+	if got := formatTime(start); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestServer(t *testing.T) {
+	clock := clock.NewFake(start.Add(7 * time.Minute))
+	server := NewServer(clock)
+	defer server.Close()
+	server.Play("p3", NewScript(start).
+		Track("Bob Dylan", "Like a Rolling Stone", 6*time.Minute).
+		Track("The Band", "The Weight", 4*time.Minute).
+		Track("Neil Young", "Harvest Moon", 5*time.Minute).
+		Gap(time.Minute).
+		Talk("News", 5*time.Minute))
+	radio := server.Radio("NRK P3", "p3")
+
+	playlist, err := radio.Playlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := playlist.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Track != "The Weight" {
+		t.Fatalf("Expected The Weight, got %s", current.Track)
+	}
+	duration, err := current.Duration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 4*time.Minute {
+		t.Fatalf("Expected %s, got %s", 4*time.Minute, duration)
+	}
+	position, err := playlist.Position(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "01:00/04:00"; position.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, position.String())
+	}
+	startTime, err := current.StartTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := start.Add(6 * time.Minute); !startTime.Equal(expected) {
+		t.Fatalf("Expected %s, got %s", expected, startTime)
+	}
+
+	// Nothing on air
+	clock.Advance(8*time.Minute + 30*time.Second)
+	live := server.LiveElements("p3")
+	if len(live) != 2 || live[0].Title != "Harvest Moon" ||
+		live[1].Title != "News" {
+		t.Fatalf("Unexpected elements: %+v", live)
+	}
+
+	// After end of script
+	clock.Advance(time.Hour)
+	if live := server.LiveElements("p3"); len(live) != 1 {
+		t.Fatalf("Expected 1 element, got %d", len(live))
+	}
+
+	// Unknown channel
+	if _, err := server.Radio("NRK P1", "p1").Playlist(); err == nil {
+		t.Fatal("Expected error for unknown channel")
+	}
+}
+
+func TestServerMalformed(t *testing.T) {
+	server := NewServer(clock.NewFake(start.Add(4 * time.Minute)))
+	defer server.Close()
+	server.Play("p3", NewScript(start).
+		Track("Bob Dylan", "Like a Rolling Stone", 3*time.Minute).
+		Malformed(`{"title": 42}`, 3*time.Minute).
+		Track("The Band", "The Weight", 4*time.Minute))
+
+	if _, err := server.Radio("NRK P3", "p3").Playlist(); err == nil {
+		t.Fatal("Expected error for malformed element")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	clock := clock.NewFake(start.Add(15 * time.Minute))
+	s := NewServer(clock)
+	defer s.Close()
+	s.Play("p3", NewScript(start).
+		Track("Bob Dylan", "Hurricane", 10*time.Minute).
+		Track("Bob Dylan", "Like a Rolling Stone", 10*time.Minute).
+		Track("The Band", "The Weight", 20*time.Minute))
+
+	radio := s.Radio("NRK P3", "p3")
+	tracks, err := radio.History(start.Add(5*time.Minute),
+		start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first track started before the window and the last track has
+	// not started yet
+	if len(tracks) != 1 || tracks[0].Track != "Like a Rolling Stone" {
+		t.Fatalf("Expected 1 track, got %v", tracks)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	clock := clock.NewFake(start)
+	s := NewServer(clock)
+	defer s.Close()
+	s.Play("p3", NewScript(start).
+		Programme("Nyheter").
+		Talk("Nyheter", 10*time.Minute).
+		Programme("Christine").
+		Track("Bob Dylan", "Hurricane", 10*time.Minute))
+
+	radio := s.Radio("NRK P3", "p3")
+	schedule, err := radio.Schedule(start.Add(5*time.Minute),
+		start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 {
+		t.Fatalf("Expected 2 programmes, got %d", len(schedule))
+	}
+	christine := schedule[1]
+	if christine.Title != "Christine" ||
+		!christine.Start.Equal(start.Add(10*time.Minute)) ||
+		!christine.End.Equal(start.Add(20*time.Minute)) {
+		t.Fatalf("Unexpected programme: %+v", christine)
+	}
+}
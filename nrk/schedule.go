@@ -0,0 +1,121 @@
+package nrk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Programme is a scheduled programme on a channel.
+type Programme struct {
+	ID    string
+	Title string
+	Start time.Time
+	End   time.Time
+}
+
+// Schedule is a list of programmes, sorted by start time.
+type Schedule []Programme
+
+type scheduleEntry struct {
+	ProgramId string `json:"programId"`
+	Title     string `json:"title"`
+	StartTime string `json:"startTime"`
+	Duration  string `json:"duration"`
+}
+
+func (p *Programme) String() string {
+	return p.Title
+}
+
+// Is returns true if the programme title is title, ignoring case.
+func (p *Programme) Is(title string) bool {
+	return strings.EqualFold(strings.TrimSpace(p.Title),
+		strings.TrimSpace(title))
+}
+
+// At returns the programme on air at t, or nil if there is none.
+func (s Schedule) At(t time.Time) *Programme {
+	for i := range s {
+		if !t.Before(s[i].Start) && t.Before(s[i].End) {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// Covers returns true if the schedule has programmes from t until at least
+// t + d.
+func (s Schedule) Covers(t time.Time, d time.Duration) bool {
+	if len(s) == 0 {
+		return false
+	}
+	return !s[0].Start.After(t) && !s[len(s)-1].End.Before(t.Add(d))
+}
+
+// Tag sets the programme of each track, by the start time of the track.
+func (s Schedule) Tag(tracks []Track) {
+	for i := range tracks {
+		start, err := tracks[i].StartTime()
+		if err != nil {
+			continue
+		}
+		if p := s.At(start); p != nil {
+			tracks[i].Programme = p.Title
+		}
+	}
+}
+
+// ScheduleURL returns the URL of the programmes between from and to.
+func (radio *Radio) ScheduleURL(from, to time.Time) string {
+	base := radio.BaseURL
+	if base == "" {
+		base = defaultURL
+	}
+	params := url.Values{
+		"from": {from.UTC().Format(time.RFC3339)},
+		"to":   {to.UTC().Format(time.RFC3339)},
+	}
+	return fmt.Sprintf("%s/channels/%s/schedule?%s", base, radio.ID,
+		params.Encode())
+}
+
+// Schedule returns the programmes on air between from and to.
+func (radio *Radio) Schedule(from, to time.Time) (Schedule, error) {
+	body, err := get(radio.httpClient(), radio.ScheduleURL(from, to))
+	if err != nil {
+		return nil, err
+	}
+	return parseSchedule(body)
+}
+
+func parseSchedule(body []byte) (Schedule, error) {
+	var entries []scheduleEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("invalid schedule response: %s", err)
+	}
+	schedule := make(Schedule, 0, len(entries))
+	for _, e := range entries {
+		start, err := parseTime(e.StartTime)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := parseDuration(e.Duration)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, Programme{
+			ID:    e.ProgramId,
+			Title: e.Title,
+			Start: start,
+			End:   start.Add(duration),
+		})
+	}
+	sort.SliceStable(schedule, func(i, j int) bool {
+		return schedule[i].Start.Before(schedule[j].Start)
+	})
+	return schedule, nil
+}
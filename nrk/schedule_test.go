@@ -0,0 +1,141 @@
+package nrk
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const scheduleResponse = `[
+  {
+    "programId": "MUHH40001015",
+    "title": "Christine",
+    "startTime": "/Date(1420102800000+0100)/",
+    "duration": "PT2H"
+  },
+  {
+    "programId": "MUHH40000115",
+    "title": "Nyheter",
+    "startTime": "/Date(1420099200000+0100)/",
+    "duration": "PT1H"
+  }
+]`
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := parseSchedule([]byte(scheduleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 {
+		t.Fatalf("Expected 2 programmes, got %d", len(schedule))
+	}
+	news := schedule[0]
+	if news.Title != "Nyheter" || news.ID != "MUHH40000115" {
+		t.Fatalf("Expected programmes sorted by start, got %+v", news)
+	}
+	start := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	if !news.Start.Equal(start) || !news.End.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Unexpected start and end: %+v", news)
+	}
+
+	invalid := []byte(`[{"startTime": "now"}]`)
+	if _, err := parseSchedule(invalid); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	schedule, err := parseSchedule([]byte(scheduleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		at    time.Time
+		title string
+	}{
+		{start.Add(-time.Second), ""},
+		{start, "Nyheter"},
+		{start.Add(time.Hour - time.Second), "Nyheter"},
+		{start.Add(time.Hour), "Christine"},
+		{start.Add(3 * time.Hour), ""},
+	}
+	for _, tt := range tests {
+		title := ""
+		if p := schedule.At(tt.at); p != nil {
+			title = p.Title
+		}
+		if title != tt.title {
+			t.Errorf("At(%s) = %q, want %q", tt.at, title, tt.title)
+		}
+	}
+	if !schedule.Covers(start, 3*time.Hour) {
+		t.Fatal("Expected schedule to cover 3 hours")
+	}
+	if schedule.Covers(start, 4*time.Hour) {
+		t.Fatal("Expected schedule to not cover 4 hours")
+	}
+	if Schedule(nil).Covers(start, 0) {
+		t.Fatal("Expected empty schedule to cover nothing")
+	}
+}
+
+func TestScheduleTag(t *testing.T) {
+	schedule, err := parseSchedule([]byte(scheduleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	tracks := []Track{
+		historyTrack("A", start.Add(30*time.Minute)),
+		historyTrack("B", start.Add(90*time.Minute)),
+		historyTrack("C", start.Add(-time.Minute)),
+	}
+	schedule.Tag(tracks)
+	for i, expected := range []string{"Nyheter", "Christine", ""} {
+		if tracks[i].Programme != expected {
+			t.Errorf("Expected %s to be tagged %q, got %q",
+				tracks[i].Track, expected, tracks[i].Programme)
+		}
+	}
+}
+
+func TestRadioSchedule(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/channels/p3/schedule" {
+				http.NotFound(w, r)
+				return
+			}
+			query = r.URL.RawQuery
+			fmt.Fprint(w, scheduleResponse)
+		}))
+	defer server.Close()
+
+	from := time.Date(2015, 1, 1, 8, 0, 0, 0, time.UTC)
+	radio := Radio{ID: "p3", BaseURL: server.URL}
+	schedule, err := radio.Schedule(from, from.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 {
+		t.Fatalf("Expected 2 programmes, got %d", len(schedule))
+	}
+	expected := "from=2015-01-01T08%3A00%3A00Z&to=2015-01-01T09%3A00%3A00Z"
+	if query != expected {
+		t.Fatalf("Expected query %s, got %s", expected, query)
+	}
+}
+
+func TestProgrammeIs(t *testing.T) {
+	p := Programme{Title: "P3 Urørt "}
+	if !p.Is("p3 urørt") {
+		t.Fatal("Expected match ignoring case and space")
+	}
+	if p.Is("P3") {
+		t.Fatal("Expected no match")
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+// BackfillResult summarizes a backfill.
+type BackfillResult struct {
+	Added    []spotify.Track
+	Present  int
+	NotFound int
+	NotMusic int
+	Failed   int
+}
+
+func (r *BackfillResult) String() string {
+	return fmt.Sprintf("added %d, already present %d, not found %d, "+
+		"not music %d, failed %d", len(r.Added), r.Present, r.NotFound,
+		r.NotMusic, r.Failed)
+}
+
+func (sync *Sync) retryHistory(source HistorySource, from,
+	to time.Time) ([]nrk.Track, error) {
+	var tracks []nrk.Track
+	err := sync.retry(time.Minute, "Retrieving radio history",
+		func() error {
+			var err error
+			tracks, err = source.History(from, to)
+			return err
+		})
+	return tracks, err
+}
+
+// Backfill adds the music played between from and to in source to the
+// playlist, in broadcast order. Tracks already in the playlist are skipped,
+// so running a backfill more than once is safe.
+func (sync *Sync) Backfill(source HistorySource, from,
+	to time.Time) (*BackfillResult, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from (%s) must be before to (%s)",
+			from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	if err := sync.initPlaylist(); err != nil {
+		return nil, err
+	}
+	var existing []spotify.Track
+	err := sync.retry(5*time.Minute, "Get playlist tracks", func() error {
+		var err error
+		existing, err = sync.Playlist.Tracks()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, t := range existing {
+		present[t.Id] = true
+	}
+	radioTracks, err := sync.retryHistory(source, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sync.log().Info("Backfilling", logger.F("elements", len(radioTracks)),
+		logger.F("from", from), logger.F("to", to))
+
+	result := &BackfillResult{}
+	for _, t := range radioTracks {
+		if !t.IsMusic() {
+			result.NotMusic++
+			continue
+		}
+		tracks, err := sync.retrySearch(&t)
+		if err != nil {
+			sync.publish(SearchFailed{Track: t, Err: err})
+			result.Failed++
+			continue
+		}
+		if len(tracks) == 0 {
+			sync.publish(SearchMiss{Track: t})
+			result.NotFound++
+			continue
+		}
+		track := &tracks[0]
+		if present[track.Id] {
+			sync.publish(AlreadyAdded{
+				Track:    t,
+				Spotify:  *track,
+				Playlist: sync.Playlist.String(),
+			})
+			result.Present++
+			continue
+		}
+		err = sync.retryAddTrack(sync.Playlist, track)
+		if err != nil {
+			sync.publish(AddFailed{
+				Track:    t,
+				Spotify:  *track,
+				Playlist: sync.Playlist.String(),
+				Err:      err,
+			})
+			result.Failed++
+			continue
+		}
+		present[track.Id] = true
+		result.Added = append(result.Added, *track)
+		sync.publish(TrackAdded{
+			Track:    t,
+			Spotify:  *track,
+			Playlist: sync.Playlist.String(),
+			Default:  true,
+			DryRun:   sync.DryRun,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/nrk/nrktest"
+	"github.com/mpolden/nrk-spotify/spotify"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func TestBackfill(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clock.NewFake(start.Add(12 * time.Hour))
+	radio := nrktest.NewServer(clock)
+	defer radio.Close()
+	day := nrktest.Day(start)
+	radio.Play("p3", day)
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.AutoCatalog = true
+
+	from := start.Add(8 * time.Hour)
+	to := start.Add(10 * time.Hour)
+	var expected []string
+	notMusic := 0
+	for _, e := range radio.History("p3", from, to) {
+		if e.Type == "Music" {
+			expected = append(expected, e.Title)
+		} else {
+			notMusic++
+		}
+	}
+	sync := &Sync{Playlist: api.Sink("NRK P3"), Clock: clock}
+	result, err := sync.Backfill(radio.Radio("NRK P3", "p3"), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := api.Tracks("NRK P3")
+	if len(tracks) != len(expected) || len(result.Added) != len(tracks) {
+		t.Fatalf("Expected %d tracks, got %d (%s)", len(expected),
+			len(tracks), result.String())
+	}
+	for i, track := range result.Added {
+		if track.Name != expected[i] || track.Id != tracks[i].Id {
+			t.Fatalf("Expected track %d to be %s, got %s", i,
+				expected[i], track.Name)
+		}
+	}
+	if notMusic == 0 || result.NotMusic != notMusic {
+		t.Fatalf("Expected %d non-music elements, got %d", notMusic,
+			result.NotMusic)
+	}
+
+	// Backfilling the same window again adds nothing
+	sync = &Sync{Playlist: api.Sink("NRK P3"), Clock: clock}
+	result, err = sync.Backfill(radio.Radio("NRK P3", "p3"), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 || result.Present != len(expected) {
+		t.Fatalf("Expected %d present tracks, got %s", len(expected),
+			result.String())
+	}
+	if n := len(api.Tracks("NRK P3")); n != len(expected) {
+		t.Fatalf("Expected %d tracks, got %d", len(expected), n)
+	}
+}
+
+func TestBackfillInvalidWindow(t *testing.T) {
+	sync := &Sync{Playlist: newTestSink()}
+	now := time.Now()
+	if _, err := sync.Backfill(&History{}, now, now); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestBackfillFromHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	history := &History{File: filepath.Join(dir, "history.jsonl")}
+
+	sync, radio, sink := newUninitializedSync(
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sync.History = history
+	initTestSync(t, sync)
+	a := sink.add("Bob Dylan", "Hurricane")
+	b := sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.add("The Band", "The Weight")
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	// The next track has not started, and is not recorded
+	played, err := history.History(testStart.Add(-time.Hour),
+		testStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(played) != 2 || played[0] != radio.playlist.Tracks[0] ||
+		played[1] != radio.playlist.Tracks[1] {
+		t.Fatalf("Expected 2 played tracks, got %v", played)
+	}
+	// Recording the same tracks again does not duplicate them
+	if err := history.Record(played...); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(history.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := len(splitLines(data)); lines != 2 {
+		t.Fatalf("Expected 2 lines, got %d", lines)
+	}
+
+	sink.tracks = sink.added
+	sink.added = nil
+	result, err := sync.Backfill(history, testStart.Add(-time.Hour),
+		testStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 1 || sink.added[0] != a {
+		t.Fatalf("Expected [%v], got %v", a, sink.added)
+	}
+	if result.Present != 1 {
+		t.Fatalf("Expected %v to be present, got %s", b,
+			result.String())
+	}
+}
+
+func splitLines(data []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+var _ HistorySource = &nrk.Radio{}
+var _ HistorySource = &History{}
+var _ PlaylistSink = &spotify.Sink{}
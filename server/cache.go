@@ -0,0 +1,106 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+type cacheEntry struct {
+	track spotify.Track
+	seq   int
+}
+
+// trackCache is an LRU cache of the tracks added to a playlist. It is safe
+// for concurrent use, and its contents can be listed.
+type trackCache struct {
+	mu      sync.Mutex
+	cache   *lru.Cache
+	entries map[string]cacheEntry
+	seq     int
+	evicted []spotify.Track
+	// onEvicted is called with tracks evicted from the cache, outside the
+	// lock
+	onEvicted func(spotify.Track)
+}
+
+func newTrackCache(maxEntries int,
+	onEvicted func(spotify.Track)) *trackCache {
+	c := &trackCache{
+		cache:     lru.New(maxEntries),
+		entries:   make(map[string]cacheEntry),
+		onEvicted: onEvicted,
+	}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
+		id, _ := key.(string)
+		delete(c.entries, id)
+		if track, ok := value.(spotify.Track); ok {
+			c.evicted = append(c.evicted, track)
+		}
+	}
+	return c
+}
+
+// flush calls onEvicted for tracks evicted while holding the lock.
+func (c *trackCache) flush() {
+	c.mu.Lock()
+	evicted := c.evicted
+	c.evicted = nil
+	c.mu.Unlock()
+	if c.onEvicted == nil {
+		return
+	}
+	for _, track := range evicted {
+		c.onEvicted(track)
+	}
+}
+
+// Contains returns true if track is cached, and marks it as recently used.
+func (c *trackCache) Contains(track *spotify.Track) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.cache.Get(track.Id)
+	return exists
+}
+
+// Add adds track to the cache, unless it is already cached.
+func (c *trackCache) Add(track *spotify.Track) {
+	c.mu.Lock()
+	if _, exists := c.cache.Get(track.Id); !exists {
+		c.cache.Add(track.Id, *track)
+		c.seq++
+		c.entries[track.Id] = cacheEntry{track: *track, seq: c.seq}
+	}
+	c.mu.Unlock()
+	c.flush()
+}
+
+func (c *trackCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.Len()
+}
+
+func (c *trackCache) Max() int {
+	return c.cache.MaxEntries
+}
+
+// Tracks returns the cached tracks, most recently added first.
+func (c *trackCache) Tracks() []spotify.Track {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq > entries[j].seq
+	})
+	tracks := make([]spotify.Track, len(entries))
+	for i, e := range entries {
+		tracks[i] = e.track
+	}
+	return tracks
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+func TestTrackCache(t *testing.T) {
+	var cache *trackCache
+	var evicted []string
+	cache = newTrackCache(2, func(track spotify.Track) {
+		// Called outside the lock, so the cache can be used
+		cache.Len()
+		evicted = append(evicted, track.Id)
+	})
+	a, b, c := spotify.Track{Id: "a"}, spotify.Track{Id: "b"},
+		spotify.Track{Id: "c"}
+	cache.Add(&a)
+	cache.Add(&b)
+	cache.Add(&a)
+	if !cache.Contains(&a) {
+		t.Fatal("Expected a to be cached")
+	}
+	// a was used most recently, so b is evicted
+	cache.Add(&c)
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("Expected b to be evicted, got %v", evicted)
+	}
+	tracks := cache.Tracks()
+	if len(tracks) != 2 || tracks[0].Id != "c" || tracks[1].Id != "a" {
+		t.Fatalf("Expected [c a], got %v", tracks)
+	}
+	if cache.Len() != 2 || cache.Max() != 2 {
+		t.Fatalf("Expected 2 of 2 tracks, got %v", cache.Tracks())
+	}
+}
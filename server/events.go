@@ -0,0 +1,367 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+// Event is something that happened during a sync.
+type Event interface {
+	// Name is a short, stable identifier of the event type
+	Name() string
+}
+
+// PlaylistOpened is published when the default playlist has been opened.
+type PlaylistOpened struct {
+	Playlist string
+}
+
+// RunStarted is published when a sync run starts.
+type RunStarted struct {
+	Time time.Time
+}
+
+// RunFinished is published when a sync run finishes, successfully or not.
+type RunFinished struct {
+	Time time.Time
+	// Duration is how long the run took
+	Duration  time.Duration
+	Next      time.Duration
+	CacheSize int
+	CacheMax  int
+}
+
+// RunFailed is published when a sync run fails.
+type RunFailed struct {
+	Time time.Time
+	Err  error
+}
+
+// TokenRefreshFailed is published when refreshing the access token of the
+// playlist starts failing.
+type TokenRefreshFailed struct {
+	Err error
+}
+
+// AttemptFailed is published when an operation which is retried fails.
+type AttemptFailed struct {
+	Operation string
+	// Attempt is the number of the failed attempt, starting at 1
+	Attempt int
+	Err     error
+	// Retry is true if the operation will be retried after Delay
+	Retry bool
+	Delay time.Duration
+}
+
+// ProgrammeOnAir is published when a programme is on air at the start of a
+// run.
+type ProgrammeOnAir struct {
+	Programme nrk.Programme
+}
+
+// ProgrammeSkipped is published when a run is skipped because of the
+// programme on air.
+type ProgrammeSkipped struct {
+	Programme nrk.Programme
+}
+
+// ScheduleFailed is published when the programme schedule cannot be fetched.
+type ScheduleFailed struct {
+	Err error
+}
+
+// NowPlaying is published with the current element of the radio.
+type NowPlaying struct {
+	Radio    string
+	Track    nrk.Track
+	Position nrk.Position
+	// Next is the next element, if known
+	Next *nrk.Track
+}
+
+// NowPlayingFailed is published when the current element cannot be
+// determined.
+type NowPlayingFailed struct {
+	Err error
+}
+
+// Played is published with the elements of the radio playlist which have
+// started.
+type Played struct {
+	Tracks []nrk.Track
+}
+
+// HistoryFailed is published when played elements cannot be recorded.
+type HistoryFailed struct {
+	Err error
+}
+
+// Searching is published before searching for a radio element.
+type Searching struct {
+	Track nrk.Track
+}
+
+// NotMusic is published when a radio element is skipped because it is not
+// music.
+type NotMusic struct {
+	Track nrk.Track
+}
+
+// TrackSkipped is published when a radio element is skipped by a programme
+// rule.
+type TrackSkipped struct {
+	Track nrk.Track
+}
+
+// PlaylistFailed is published when the playlist of a programme cannot be
+// opened.
+type PlaylistFailed struct {
+	Programme string
+	Err       error
+}
+
+// SearchFailed is published when searching for a radio element fails.
+type SearchFailed struct {
+	Track nrk.Track
+	Err   error
+}
+
+// SearchMiss is published when a radio element is not found in Spotify.
+type SearchMiss struct {
+	Track nrk.Track
+}
+
+// AlreadyAdded is published when a found track is already in the playlist.
+type AlreadyAdded struct {
+	Track    nrk.Track
+	Spotify  spotify.Track
+	Playlist string
+}
+
+// TrackAdded is published when a track is added to a playlist.
+type TrackAdded struct {
+	Track    nrk.Track
+	Spotify  spotify.Track
+	Playlist string
+	// Default is true if the track was added to the default playlist
+	Default bool
+	// DryRun is true if the playlist was left unchanged
+	DryRun bool
+}
+
+// AddFailed is published when a track cannot be added to a playlist.
+type AddFailed struct {
+	Track    nrk.Track
+	Spotify  spotify.Track
+	Playlist string
+	Err      error
+}
+
+// TrackEvicted is published when a track evicted from the cache is deleted
+// from its playlist.
+type TrackEvicted struct {
+	Spotify  spotify.Track
+	Playlist string
+	// DryRun is true if the playlist was left unchanged
+	DryRun bool
+}
+
+// EvictFailed is published when an evicted track cannot be deleted.
+type EvictFailed struct {
+	Spotify  spotify.Track
+	Playlist string
+	Err      error
+}
+
+func (PlaylistOpened) Name() string     { return "playlist_opened" }
+func (RunStarted) Name() string         { return "run_started" }
+func (RunFinished) Name() string        { return "run_finished" }
+func (RunFailed) Name() string          { return "run_failed" }
+func (AttemptFailed) Name() string      { return "attempt_failed" }
+func (TokenRefreshFailed) Name() string { return "token_refresh_failed" }
+func (ProgrammeOnAir) Name() string     { return "programme_on_air" }
+func (ProgrammeSkipped) Name() string   { return "programme_skipped" }
+func (ScheduleFailed) Name() string     { return "schedule_failed" }
+func (NowPlaying) Name() string         { return "now_playing" }
+func (NowPlayingFailed) Name() string   { return "now_playing_failed" }
+func (Played) Name() string             { return "played" }
+func (HistoryFailed) Name() string      { return "history_failed" }
+func (Searching) Name() string          { return "searching" }
+func (NotMusic) Name() string           { return "not_music" }
+func (TrackSkipped) Name() string       { return "track_skipped" }
+func (PlaylistFailed) Name() string     { return "playlist_failed" }
+func (SearchFailed) Name() string       { return "search_failed" }
+func (SearchMiss) Name() string         { return "search_miss" }
+func (AlreadyAdded) Name() string       { return "already_added" }
+func (TrackAdded) Name() string         { return "track_added" }
+func (AddFailed) Name() string          { return "add_failed" }
+func (TrackEvicted) Name() string       { return "track_evicted" }
+func (EvictFailed) Name() string        { return "evict_failed" }
+
+type subscriber struct {
+	id int
+	fn func(Event)
+}
+
+// Bus delivers events to subscribers. Events are delivered synchronously, in
+// the order of subscription, so subscribers should not block.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers []subscriber
+	next        int
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls fn for every event published after the call. The returned
+// function cancels the subscription.
+func (bus *Bus) Subscribe(fn func(Event)) func() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	id := bus.next
+	bus.next++
+	bus.subscribers = append(bus.subscribers, subscriber{id: id, fn: fn})
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		for i, s := range bus.subscribers {
+			if s.id == id {
+				bus.subscribers = append(bus.subscribers[:i:i],
+					bus.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers event to all subscribers.
+func (bus *Bus) Publish(event Event) {
+	bus.mu.Lock()
+	subscribers := bus.subscribers
+	bus.mu.Unlock()
+	for _, s := range subscribers {
+		s.fn(event)
+	}
+}
+
+// EventLogger returns a subscriber which writes events to log.
+func EventLogger(log *logger.Logger) func(Event) {
+	return func(event Event) { logEvent(log, event) }
+}
+
+func trackField(track nrk.Track) logger.Field {
+	return logger.F("track", track.String())
+}
+
+func spotifyFields(track spotify.Track, playlist string) []logger.Field {
+	return []logger.Field{
+		logger.F("spotify_id", track.Id),
+		logger.F("spotify_track", track.String()),
+		logger.F("playlist", playlist),
+	}
+}
+
+func logEvent(log *logger.Logger, event Event) {
+	errField := func(err error) logger.Field {
+		return logger.F("error", err)
+	}
+	switch e := event.(type) {
+	case PlaylistOpened:
+		log.Info("Opened playlist", logger.F("playlist", e.Playlist))
+	case RunStarted:
+		log.Info("Running sync")
+	case RunFinished:
+		log.Info("Sync finished", logger.F("duration", e.Duration),
+			logger.F("next", e.Next),
+			logger.F("cache_size", e.CacheSize),
+			logger.F("cache_max", e.CacheMax))
+	case RunFailed:
+		log.Error("Sync failed", errField(e.Err))
+	case TokenRefreshFailed:
+		log.Error("Failed to refresh token", errField(e.Err))
+	case AttemptFailed:
+		fields := []logger.Field{
+			logger.F("operation", e.Operation),
+			logger.F("attempt", e.Attempt),
+			errField(e.Err),
+		}
+		if e.Retry {
+			log.Warn("Attempt failed, retrying",
+				append(fields, logger.F("delay", e.Delay))...)
+		} else {
+			log.Error("Attempt failed, giving up", fields...)
+		}
+	case ProgrammeOnAir:
+		log.Info("Programme on air",
+			logger.F("programme", e.Programme.String()))
+	case ProgrammeSkipped:
+		log.Info("Skipping programme",
+			logger.F("programme", e.Programme.String()),
+			logger.F("until", e.Programme.End))
+	case ScheduleFailed:
+		log.Error("Failed to get schedule", errField(e.Err))
+	case NowPlaying:
+		fields := []logger.Field{
+			logger.F("radio", e.Radio),
+			trackField(e.Track),
+			logger.F("position", e.Position.String()),
+		}
+		if log.Format == logger.Text {
+			fields = append(fields, logger.F("progress",
+				e.Position.Symbol(10, log.Colors)))
+		}
+		log.Info("Now playing", fields...)
+	case NowPlayingFailed:
+		log.Error("Failed to get current track", errField(e.Err))
+	case Played:
+		log.Debug("Played", logger.F("elements", len(e.Tracks)))
+	case HistoryFailed:
+		log.Error("Failed to record history", errField(e.Err))
+	case Searching:
+		log.Debug("Searching", trackField(e.Track))
+	case NotMusic:
+		log.Debug("Not music, skipping", trackField(e.Track))
+	case TrackSkipped:
+		log.Info("Programme skipped, skipping", trackField(e.Track),
+			logger.F("programme", e.Track.Programme))
+	case PlaylistFailed:
+		log.Error("Failed to open playlist",
+			logger.F("programme", e.Programme), errField(e.Err))
+	case SearchFailed:
+		log.Error("Search failed", trackField(e.Track), errField(e.Err))
+	case SearchMiss:
+		log.Warn("Track not found", trackField(e.Track))
+	case AlreadyAdded:
+		log.Info("Already added", append([]logger.Field{
+			trackField(e.Track)},
+			spotifyFields(e.Spotify, e.Playlist)...)...)
+	case TrackAdded:
+		msg := "Added track"
+		if e.DryRun {
+			msg = "Would add track"
+		}
+		log.Info(msg, append([]logger.Field{trackField(e.Track)},
+			spotifyFields(e.Spotify, e.Playlist)...)...)
+	case AddFailed:
+		log.Error("Failed to add track", append([]logger.Field{
+			trackField(e.Track), errField(e.Err)},
+			spotifyFields(e.Spotify, e.Playlist)...)...)
+	case TrackEvicted:
+		msg := "Deleted evicted track"
+		if e.DryRun {
+			msg = "Would delete evicted track"
+		}
+		log.Info(msg, spotifyFields(e.Spotify, e.Playlist)...)
+	case EvictFailed:
+		fields := spotifyFields(e.Spotify, e.Playlist)
+		log.Error("Failed to delete evicted track",
+			append(fields, errField(e.Err))...)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	var got []string
+	unsubscribeA := bus.Subscribe(func(e Event) {
+		got = append(got, "a:"+e.Name())
+	})
+	bus.Subscribe(func(e Event) {
+		got = append(got, "b:"+e.Name())
+	})
+	bus.Publish(RunStarted{})
+	unsubscribeA()
+	unsubscribeA()
+	bus.Publish(RunFailed{})
+
+	expected := []string{"a:run_started", "b:run_started", "b:run_failed"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestSharedEvents(t *testing.T) {
+	a, _, sinkA := newUninitializedSync(
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sinkA.add("Bob Dylan", "Like a Rolling Stone")
+	b, _, _ := newUninitializedSync()
+	b.Events = a.Events
+	initTestSync(t, a)
+	initTestSync(t, b)
+	added := 0
+	a.Events.Subscribe(func(e Event) {
+		if _, ok := e.(TrackAdded); ok {
+			added++
+		}
+	})
+
+	if _, err := a.run(); err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Fatalf("Expected 1 added track on shared bus, got %d", added)
+	}
+	if n := len(a.Status().Recent); n == 0 {
+		t.Fatal("Expected matches in status of a")
+	}
+	// Events of a are not recorded by b
+	if status := b.Status(); len(status.Recent) != 0 ||
+		status.LastRun != nil {
+		t.Fatalf("Expected empty status of b, got %+v", status)
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("", "Nyheter", "Program", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	b := sink.add("The Band", "The Weight")
+	var events []Event
+	sync.Events.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+
+	<-sync.runForever()
+	sink.addErr = fmt.Errorf("gopher says no")
+	// A new cache makes the sync add b again
+	sync.cache = newTrackCache(sync.CacheSize, nil)
+	<-sync.runForever()
+
+	var names []string
+	attempts := 0
+	for _, e := range events {
+		// Failed attempts depend on the backoff, and are counted
+		// separately
+		if _, ok := e.(AttemptFailed); ok {
+			attempts++
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	if attempts < 2 {
+		t.Fatalf("Expected failed add to be retried, got %d attempts",
+			attempts)
+	}
+	expected := []string{
+		"run_started", "now_playing", "played",
+		"searching", "not_music",
+		"searching", "track_added",
+		"run_finished",
+		"run_started", "now_playing", "played",
+		"searching", "not_music",
+		"searching", "add_failed",
+		"run_finished",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	added := events[6].(TrackAdded)
+	if added.Spotify != b || added.Track.Track != "The Weight" ||
+		!added.Default || added.Playlist != "NRK P3" {
+		t.Fatalf("Unexpected event: %+v", added)
+	}
+	finished := events[7].(RunFinished)
+	if finished.Next != sync.Interval || finished.CacheSize != 1 ||
+		finished.CacheMax != 10 {
+		t.Fatalf("Unexpected event: %+v", finished)
+	}
+	playing := events[1].(NowPlaying)
+	if playing.Track.Track != "Nyheter" || playing.Radio != "NRK P3" {
+		t.Fatalf("Unexpected event: %+v", playing)
+	}
+}
+
+func TestRunFailedEvent(t *testing.T) {
+	sync, radio, _ := newTestSync(t)
+	radio.err = fmt.Errorf("gopher says no")
+	var failed []RunFailed
+	sync.Events.Subscribe(func(e Event) {
+		if e, ok := e.(RunFailed); ok {
+			failed = append(failed, e)
+		}
+	})
+	<-sync.runForever()
+	if len(failed) != 1 || failed[0].Err != radio.err {
+		t.Fatalf("Expected 1 failure, got %v", failed)
+	}
+}
+
+func TestEventLogger(t *testing.T) {
+	// Every event can be logged
+	for _, e := range []Event{PlaylistOpened{}, RunStarted{}, RunFinished{},
+		RunFailed{}, AttemptFailed{}, ProgrammeOnAir{},
+		ProgrammeSkipped{}, ScheduleFailed{}, NowPlaying{},
+		NowPlayingFailed{}, Played{}, HistoryFailed{}, Searching{},
+		NotMusic{}, TrackSkipped{}, PlaylistFailed{}, SearchFailed{},
+		SearchMiss{}, AlreadyAdded{}, TrackAdded{}, AddFailed{},
+		TrackEvicted{}, EvictFailed{}, TokenRefreshFailed{}} {
+		EventLogger(Log)(e)
+	}
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.JSON, logger.Info).With(
+		logger.F("channel", "p3"))
+	log.Clock = clock.NewFake(testStart)
+	logEvent := EventLogger(log)
+	logEvent(Searching{Track: testTrack("The Band", "The Weight", "Music",
+		0)})
+	logEvent(AttemptFailed{Operation: "Search", Attempt: 2,
+		Err: fmt.Errorf("gopher says no"), Retry: true,
+		Delay: time.Second})
+	logEvent(TrackAdded{
+		Track:    testTrack("The Band", "The Weight", "Music", 0),
+		Spotify:  spotify.Track{Id: "abc", Name: "The Weight"},
+		Playlist: "NRK P3",
+	})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected debug event to be filtered, got %q", lines)
+	}
+	var records []map[string]interface{}
+	for _, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	attempt, added := records[0], records[1]
+	if attempt["level"] != "warn" || attempt["attempt"] != 2.0 ||
+		attempt["delay"] != "1s" || attempt["channel"] != "p3" ||
+		attempt["error"] != "gopher says no" {
+		t.Fatalf("Unexpected record: %v", attempt)
+	}
+	if added["level"] != "info" || added["msg"] != "Added track" ||
+		added["spotify_id"] != "abc" ||
+		added["track"] != "The Band - The Weight" ||
+		added["time"] != testStart.Format(time.RFC3339Nano) {
+		t.Fatalf("Unexpected record: %v", added)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultStaleRuns is the default number of intervals without a successful
+// run before a sync is not ready.
+const defaultStaleRuns = 3
+
+// Check is the result of a health check.
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Health is the result of a set of health checks. It is OK if all checks are.
+type Health struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks"`
+}
+
+// refresher is a playlist whose client refreshes access tokens.
+type refresher interface {
+	RefreshError() error
+}
+
+// healthRecorder keeps the state needed by health checks, as seen through
+// the events of a sync.
+type healthRecorder struct {
+	mu       sync.Mutex
+	opened   bool
+	started  *time.Time
+	nextSync *time.Time
+	// succeeded is when the last successful run finished, and expected when
+	// the run after it was scheduled
+	succeeded *time.Time
+	expected  *time.Time
+	// State of the current run
+	failed  bool
+	skipped bool
+	fed     bool
+	// feedErr is the result of the last attempt to read the radio feed
+	feedChecked bool
+	feedErr     error
+}
+
+func (r *healthRecorder) record(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e := event.(type) {
+	case PlaylistOpened:
+		r.opened = true
+	case RunStarted:
+		started := e.Time
+		r.started = &started
+		r.failed, r.skipped, r.fed = false, false, false
+	case ProgrammeSkipped:
+		r.skipped = true
+	case Played:
+		r.fed = true
+		r.feedChecked = true
+		r.feedErr = nil
+		if len(e.Tracks) == 0 {
+			r.feedErr = fmt.Errorf("no elements played")
+		}
+	case RunFailed:
+		r.failed = true
+		// Only reading the feed can fail a run before it is read
+		if !r.fed && !r.skipped {
+			r.feedChecked = true
+			r.feedErr = e.Err
+		}
+	case RunFinished:
+		r.started = nil
+		next := e.Time.Add(e.Next)
+		r.nextSync = &next
+		if !r.failed {
+			finished := e.Time
+			r.succeeded = &finished
+			r.expected = &next
+		}
+	}
+}
+
+func (sync *Sync) staleAfter() time.Duration {
+	runs := sync.StaleRuns
+	if runs <= 0 {
+		runs = defaultStaleRuns
+	}
+	return time.Duration(runs) * sync.Interval
+}
+
+func newHealth(checks ...Check) Health {
+	health := Health{OK: true, Checks: checks}
+	for _, c := range checks {
+		health.OK = health.OK && c.OK
+	}
+	return health
+}
+
+func check(name string, err error) Check {
+	if err != nil {
+		return Check{Name: name, Error: err.Error()}
+	}
+	return Check{Name: name, OK: true}
+}
+
+// Live returns the liveness of the sync. A sync is live unless its run loop
+// has stalled, either in a run or between runs.
+func (sync *Sync) Live() Health {
+	sync.events()
+	r := sync.health
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := sync.clock().Now()
+	stale := sync.staleAfter()
+	var err error
+	if r.started != nil && now.Sub(*r.started) > stale {
+		err = fmt.Errorf("run started at %s has not finished",
+			r.started.Format(time.RFC3339))
+	} else if r.started == nil && r.nextSync != nil &&
+		now.Sub(*r.nextSync) > stale {
+		err = fmt.Errorf("run scheduled at %s has not started",
+			r.nextSync.Format(time.RFC3339))
+	}
+	return newHealth(check("run_loop", err))
+}
+
+// Ready returns the readiness of the sync. A sync is ready when its playlist
+// is initialized, a run has succeeded within the last StaleRuns intervals,
+// the last token refresh succeeded and the radio feed returned data.
+func (sync *Sync) Ready() Health {
+	sync.events()
+	r := sync.health
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := sync.clock().Now()
+
+	var playlistErr error
+	if !r.opened {
+		playlistErr = fmt.Errorf("playlist is not initialized")
+	}
+
+	// Count from when the next run was expected, so waiting for a skipped
+	// programme to end does not make the sync stale
+	var runErr error
+	if r.succeeded == nil {
+		runErr = fmt.Errorf("no successful run")
+	} else if now.Sub(*r.expected) > sync.staleAfter()-sync.Interval {
+		runErr = fmt.Errorf("last successful run finished at %s",
+			r.succeeded.Format(time.RFC3339))
+	}
+
+	var tokenErr error
+	if refresher, ok := sync.Playlist.(refresher); ok {
+		tokenErr = refresher.RefreshError()
+	}
+
+	feedErr := r.feedErr
+	if !r.feedChecked {
+		feedErr = fmt.Errorf("radio feed has not been read")
+	}
+
+	checks := []Check{
+		check("playlist", playlistErr),
+		check("last_run", runErr),
+		check("token", tokenErr),
+		check("radio", feedErr),
+	}
+	return newHealth(checks...)
+}
+
+func (sync *Sync) serveHealth(health func() Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := health()
+		status := http.StatusOK
+		if !h.OK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, h)
+	}
+}
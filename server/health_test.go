@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+)
+
+// refreshingSink is a playlist whose token refresh can fail.
+type refreshingSink struct {
+	*testSink
+	refreshErr error
+}
+
+func (s *refreshingSink) RefreshError() error { return s.refreshErr }
+
+func getHealth(t *testing.T, url string, status int) Health {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("Expected %d from %s, got %d", status, url,
+			resp.StatusCode)
+	}
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return health
+}
+
+func failing(health Health) map[string]string {
+	failed := make(map[string]string)
+	for _, c := range health.Checks {
+		if !c.OK {
+			failed[c.Name] = c.Error
+		}
+	}
+	return failed
+}
+
+func TestReady(t *testing.T) {
+	sync, radio, sink := newUninitializedSync(
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	refreshing := &refreshingSink{testSink: sink}
+	sync.Playlist = refreshing
+	server := httptest.NewServer(sync.Handler())
+	defer server.Close()
+
+	health := getHealth(t, server.URL+"/readyz", 503)
+	failed := failing(health)
+	if len(health.Checks) != 4 || len(failed) != 3 ||
+		failed["playlist"] == "" || failed["last_run"] == "" ||
+		failed["radio"] == "" {
+		t.Fatalf("Expected all but token check to fail, got %+v",
+			health)
+	}
+
+	initTestSync(t, sync)
+	<-sync.runForever()
+	if health := getHealth(t, server.URL+"/readyz", 200); !health.OK {
+		t.Fatalf("Expected ready, got %+v", health)
+	}
+
+	refreshing.refreshErr = fmt.Errorf("token refresh failed (400)")
+	failed = failing(sync.Ready())
+	if len(failed) != 1 || failed["token"] != "token refresh failed (400)" {
+		t.Fatalf("Expected token check to fail, got %v", failed)
+	}
+	refreshing.refreshErr = nil
+
+	// A failing feed makes the sync unready immediately, and the last run
+	// stale after three intervals
+	radio.err = fmt.Errorf("gopher says no")
+	<-sync.runForever()
+	failed = failing(sync.Ready())
+	if len(failed) != 1 || failed["radio"] != "gopher says no" {
+		t.Fatalf("Expected radio check to fail, got %v", failed)
+	}
+	<-sync.runForever()
+	<-sync.runForever()
+	failed = failing(sync.Ready())
+	if len(failed) != 2 || failed["last_run"] == "" {
+		t.Fatalf("Expected last run check to fail, got %v", failed)
+	}
+
+	radio.err = nil
+	<-sync.runForever()
+	if health := sync.Ready(); !health.OK {
+		t.Fatalf("Expected ready after recovery, got %+v", health)
+	}
+}
+
+func TestReadyEmptyFeed(t *testing.T) {
+	sync, _, _ := newTestSync(t)
+	<-sync.runForever()
+	failed := failing(sync.Ready())
+	if failed["radio"] != "no elements played" {
+		t.Fatalf("Expected radio check to fail, got %v", failed)
+	}
+}
+
+func TestLive(t *testing.T) {
+	sync, _, _ := newTestSync(t,
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute))
+	server := httptest.NewServer(sync.Handler())
+	defer server.Close()
+	if health := getHealth(t, server.URL+"/healthz", 200); !health.OK {
+		t.Fatalf("Expected live, got %+v", health)
+	}
+
+	<-sync.runForever()
+	clock := sync.Clock.(*clock.Fake)
+	clock.Advance(15 * time.Minute)
+	if health := sync.Live(); !health.OK {
+		t.Fatalf("Expected live within three intervals, got %+v",
+			health)
+	}
+	clock.Advance(time.Second)
+	health := getHealth(t, server.URL+"/healthz", 503)
+	if failed := failing(health); failed["run_loop"] == "" {
+		t.Fatalf("Expected run loop check to fail, got %+v", health)
+	}
+
+	sync.publish(RunStarted{Time: clock.Now()})
+	if health := sync.Live(); !health.OK {
+		t.Fatalf("Expected live while running, got %+v", health)
+	}
+	clock.Advance(16 * time.Minute)
+	if failed := failing(sync.Live()); failed["run_loop"] == "" {
+		t.Fatal("Expected stuck run to fail run loop check")
+	}
+}
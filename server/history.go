@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+// History is a log of played radio elements, stored as one JSON object per
+// line in File.
+type History struct {
+	File string
+
+	mu       sync.Mutex
+	recorded map[nrk.Track]bool
+}
+
+// Record appends tracks to the history. Tracks recorded earlier by this
+// History are not written again.
+func (history *History) Record(tracks ...nrk.Track) error {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	if history.recorded == nil {
+		history.recorded = make(map[nrk.Track]bool)
+	}
+	f, err := os.OpenFile(history.File,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	recorded := make(map[nrk.Track]bool)
+	for _, t := range tracks {
+		if history.recorded[t] {
+			recorded[t] = true
+			continue
+		}
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+		recorded[t] = true
+	}
+	// Only the most recent tracks are remembered, as the radio playlist
+	// moves forward
+	history.recorded = recorded
+	return nil
+}
+
+// History returns the recorded tracks which started between from and to, in
+// broadcast order.
+func (history *History) History(from, to time.Time) ([]nrk.Track, error) {
+	f, err := os.Open(history.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tracks := []nrk.Track{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var t nrk.Track
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", history.File, n,
+				err)
+		}
+		tracks = append(tracks, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nrk.Between(tracks, from, to), nil
+}
+
+// subscriber returns a function which records Played events, and publishes
+// failures to bus.
+func (history *History) subscriber(bus *Bus) func(Event) {
+	return func(event Event) {
+		played, ok := event.(Played)
+		if !ok {
+			return
+		}
+		if err := history.Record(played.Tracks...); err != nil {
+			bus.Publish(HistoryFailed{Err: err})
+		}
+	}
+}
+
+func (history *History) String() string {
+	return history.File
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/metrics"
+)
+
+// staticSegments are the path segments of the Spotify and NRK APIs which are
+// not identifiers. Other segments are replaced by :id in endpoint labels.
+var staticSegments = map[string]bool{
+	"v1":           true,
+	"api":          true,
+	"token":        true,
+	"me":           true,
+	"search":       true,
+	"users":        true,
+	"playlists":    true,
+	"tracks":       true,
+	"channels":     true,
+	"liveelements": true,
+	"now":          true,
+	"schedule":     true,
+}
+
+// Metrics of a sync, labelled by channel.
+type Metrics struct {
+	Registry *metrics.Registry
+	Channel  string
+	Clock    clock.Clock
+
+	runs         metrics.Vec
+	runFailures  metrics.Vec
+	searches     metrics.Vec
+	matches      metrics.Vec
+	misses       metrics.Vec
+	adds         metrics.Vec
+	evictions    metrics.Vec
+	retries      metrics.Vec
+	apiErrors    metrics.Vec
+	refreshes    metrics.Vec
+	latency      metrics.Vec
+	cacheEntries metrics.Vec
+	cacheMax     metrics.Vec
+	nextSync     metrics.Vec
+
+	mu         sync.Mutex
+	nextSyncAt time.Time
+}
+
+// NewMetrics registers the metrics of a sync of channel in a new registry.
+func NewMetrics(channel string) *Metrics {
+	r := metrics.NewRegistry()
+	m := &Metrics{Registry: r, Channel: channel}
+	m.runs = r.Counter("nrk_spotify_runs_total",
+		"Number of sync runs.", "channel")
+	m.runFailures = r.Counter("nrk_spotify_run_failures_total",
+		"Number of failed sync runs.", "channel")
+	m.searches = r.Counter("nrk_spotify_searches_total",
+		"Number of Spotify searches for radio tracks.", "channel")
+	m.matches = r.Counter("nrk_spotify_matches_total",
+		"Number of searches which found a track.", "channel")
+	m.misses = r.Counter("nrk_spotify_misses_total",
+		"Number of searches which found no track.", "channel")
+	m.adds = r.Counter("nrk_spotify_adds_total",
+		"Number of tracks added to playlists.", "channel")
+	m.evictions = r.Counter("nrk_spotify_evictions_total",
+		"Number of evicted tracks deleted from playlists.", "channel")
+	m.retries = r.Counter("nrk_spotify_retries_total",
+		"Number of retried operations.", "channel", "operation")
+	m.apiErrors = r.Counter("nrk_spotify_api_errors_total",
+		"Number of failed API requests.", "channel", "api", "endpoint",
+		"status")
+	m.refreshes = r.Counter("nrk_spotify_token_refreshes_total",
+		"Number of Spotify access token refreshes.", "channel")
+	m.latency = r.Histogram("nrk_spotify_request_duration_seconds",
+		"Latency of API requests.", metrics.DefaultBuckets, "channel",
+		"api", "endpoint")
+	m.cacheEntries = r.Gauge("nrk_spotify_cache_entries",
+		"Number of tracks in the cache.", "channel")
+	m.cacheMax = r.Gauge("nrk_spotify_cache_max_entries",
+		"Capacity of the cache.", "channel")
+	m.nextSync = r.Gauge("nrk_spotify_next_sync_seconds",
+		"Time until the next sync.", "channel")
+	return m
+}
+
+func (m *Metrics) record(event Event) {
+	switch e := event.(type) {
+	case RunStarted:
+		m.runs.Inc(m.Channel)
+	case RunFailed:
+		m.runFailures.Inc(m.Channel)
+	case RunFinished:
+		m.cacheEntries.Set(float64(e.CacheSize), m.Channel)
+		m.cacheMax.Set(float64(e.CacheMax), m.Channel)
+		m.mu.Lock()
+		m.nextSyncAt = e.Time.Add(e.Next)
+		m.mu.Unlock()
+		m.nextSync.Set(e.Next.Seconds(), m.Channel)
+	case AttemptFailed:
+		if e.Retry {
+			m.retries.Inc(m.Channel, e.Operation)
+		}
+	case SearchMiss:
+		m.searches.Inc(m.Channel)
+		m.misses.Inc(m.Channel)
+	case AlreadyAdded, TrackAdded, AddFailed:
+		m.searches.Inc(m.Channel)
+		m.matches.Inc(m.Channel)
+		if e, ok := event.(TrackAdded); ok && !e.DryRun {
+			m.adds.Inc(m.Channel)
+		}
+	case SearchFailed:
+		m.searches.Inc(m.Channel)
+	case TrackEvicted:
+		if !e.DryRun {
+			m.evictions.Inc(m.Channel)
+		}
+	}
+}
+
+// endpoint returns path with identifiers replaced by :id.
+func endpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		if !staticSegments[s] {
+			segments[i] = ":id"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+type instrumentedTransport struct {
+	metrics *Metrics
+	api     string
+	base    http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	m := t.metrics
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	endpoint := endpoint(req.URL.Path)
+	m.latency.Observe(time.Since(start).Seconds(), m.Channel, t.api,
+		endpoint)
+	if err != nil {
+		m.apiErrors.Inc(m.Channel, t.api, endpoint, "error")
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		m.apiErrors.Inc(m.Channel, t.api, endpoint,
+			strconv.Itoa(resp.StatusCode))
+	} else if endpoint == "/api/token" {
+		m.refreshes.Inc(m.Channel)
+	}
+	return resp, nil
+}
+
+// Transport returns a transport which records request metrics of api, and
+// sends requests using base.
+func (m *Metrics) Transport(api string,
+	base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &instrumentedTransport{metrics: m, api: api, base: base}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	nextSyncAt := m.nextSyncAt
+	m.mu.Unlock()
+	if !nextSyncAt.IsZero() {
+		now := clock.OrReal(m.Clock).Now()
+		m.nextSync.Set(nextSyncAt.Sub(now).Seconds(), m.Channel)
+	}
+	m.Registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/nrk/nrktest"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func TestEndpoint(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"/v1/me", "/v1/me"},
+		{"/v1/users/foo/playlists/bar/tracks",
+			"/v1/users/:id/playlists/:id/tracks"},
+		{"/channels/p3/liveelements/now",
+			"/channels/:id/liveelements/now"},
+		{"/api/token", "/api/token"},
+	}
+	for _, tt := range tests {
+		if got := endpoint(tt.in); got != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	start := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := clock.NewFake(start)
+	radio := nrktest.NewServer(clock)
+	defer radio.Close()
+	radio.Play("p3", nrktest.NewScript(start.Add(-4*time.Minute)).
+		Track("Bob Dylan", "Hurricane", 4*time.Minute).
+		Track("Bob Dylan", "Like a Rolling Stone", 4*time.Minute).
+		Track("The Band", "The Weight", 4*time.Minute))
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.AddTrack("Bob Dylan", "Like a Rolling Stone")
+	api.Fail("/v1/search", 500, 1)
+
+	m := NewMetrics("p3")
+	m.Clock = clock
+	nrkRadio := radio.Radio("NRK P3", "p3")
+	nrkRadio.Client = &http.Client{Transport: m.Transport("nrk", nil)}
+	sink := api.Sink("NRK P3")
+	sink.Spotify.Client = &http.Client{
+		Transport: m.Transport("spotify", nil),
+	}
+	api.ExpireToken()
+	var finished RunFinished
+	bus := NewBus()
+	bus.Subscribe(func(e Event) {
+		if f, ok := e.(RunFinished); ok {
+			finished = f
+		}
+	})
+	sync := &Sync{
+		Radio:     nrkRadio,
+		Playlist:  sink,
+		Interval:  5 * time.Minute,
+		CacheSize: 10,
+		Clock:     clock,
+		Metrics:   m,
+		Events:    bus,
+	}
+	if err := sync.initPlaylist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	<-sync.runForever()
+
+	counters := map[string]float64{
+		"runs":      m.runs.Value("p3"),
+		"searches":  m.searches.Value("p3"),
+		"matches":   m.matches.Value("p3"),
+		"misses":    m.misses.Value("p3"),
+		"adds":      m.adds.Value("p3"),
+		"refreshes": m.refreshes.Value("p3"),
+		"retries":   m.retries.Value("p3", "Search"),
+		"errors": m.apiErrors.Value("p3", "spotify",
+			"/v1/search", "500"),
+		"cache": m.cacheEntries.Value("p3"),
+	}
+	expected := map[string]float64{
+		"runs":      1,
+		"searches":  2,
+		"matches":   1,
+		"misses":    1,
+		"adds":      1,
+		"refreshes": 1,
+		"retries":   1,
+		"errors":    1,
+		"cache":     1,
+	}
+	for name, v := range expected {
+		if counters[name] != v {
+			t.Errorf("Expected %s to be %f, got %f", name, v,
+				counters[name])
+		}
+	}
+	if m.latency.Value("p3", "nrk", "/channels/:id/liveelements/now") != 1 {
+		t.Error("Expected NRK latency to be observed")
+	}
+
+	next := finished.Time.Add(finished.Next).Sub(clock.Now())
+	server := httptest.NewServer(sync.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`nrk_spotify_adds_total{channel="p3"} 1`,
+		fmt.Sprintf(`nrk_spotify_next_sync_seconds{channel="p3"} %g`,
+			next.Seconds()),
+		`nrk_spotify_cache_max_entries{channel="p3"} 10`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected %q in\n%s", line, body)
+		}
+	}
+}
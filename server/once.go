@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+// RunResult summarizes a single run.
+type RunResult struct {
+	Added    []nrk.Track
+	Present  []nrk.Track
+	NotFound []nrk.Track
+	// Skipped are the elements skipped by a programme rule
+	Skipped  []nrk.Track
+	NotMusic int
+	Failed   int
+	// Programme is set if the run was skipped because of the programme on
+	// air
+	Programme *nrk.Programme
+	// DryRun is true if added tracks were only logged
+	DryRun bool
+}
+
+func (r *RunResult) String() string {
+	if r.Programme != nil {
+		return fmt.Sprintf("skipped programme %s", r.Programme.Title)
+	}
+	added := "added"
+	if r.DryRun {
+		added = "would add"
+	}
+	return fmt.Sprintf("%s %d, already added %d, not found %d, "+
+		"skipped %d, not music %d, failed %d", added, len(r.Added),
+		len(r.Present), len(r.NotFound), len(r.Skipped), r.NotMusic,
+		r.Failed)
+}
+
+func (r *RunResult) record(event Event) {
+	switch e := event.(type) {
+	case ProgrammeSkipped:
+		programme := e.Programme
+		r.Programme = &programme
+	case TrackAdded:
+		r.Added = append(r.Added, e.Track)
+		r.DryRun = e.DryRun
+	case AlreadyAdded:
+		r.Present = append(r.Present, e.Track)
+	case SearchMiss:
+		r.NotFound = append(r.NotFound, e.Track)
+	case TrackSkipped:
+		r.Skipped = append(r.Skipped, e.Track)
+	case NotMusic:
+		r.NotMusic++
+	case SearchFailed, AddFailed, PlaylistFailed:
+		r.Failed++
+	}
+}
+
+// RunOnce runs the sync a single time and summarizes what it did. The sync
+// must be initialized. An error is returned if the run failed.
+func (sync *Sync) RunOnce() (*RunResult, error) {
+	result := &RunResult{DryRun: sync.DryRun}
+	cancel := sync.events().Subscribe(result.record)
+	defer cancel()
+	_, err := sync.runOnce()
+	return result, err
+}
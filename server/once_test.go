@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+func TestRunOnce(t *testing.T) {
+	sync, radio, sink := newTestSync(t,
+		testTrack("", "Nyheter", "Program", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+
+	result, err := sync.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 1 || len(result.NotFound) != 1 ||
+		result.NotFound[0].Track != "The Weight" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	expected := "added 1, already added 0, not found 1, skipped 0, " +
+		"not music 0, failed 0"
+	if s := result.String(); s != expected {
+		t.Fatalf("Expected %q, got %q", expected, s)
+	}
+
+	// Results of earlier runs are not included
+	result, err = sync.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 || len(result.Present) != 1 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+
+	radio.err = fmt.Errorf("gopher says no")
+	if _, err := sync.RunOnce(); err != radio.err {
+		t.Fatalf("Expected %q, got %v", radio.err, err)
+	}
+	if status := sync.Status(); status.LastRun.Error != radio.err.Error() {
+		t.Fatalf("Expected failed run in status, got %+v",
+			status.LastRun)
+	}
+}
+
+func TestRunOnceSkippedProgramme(t *testing.T) {
+	result := &RunResult{Programme: &nrk.Programme{Title: "Nyheter"}}
+	if s := result.String(); s != "skipped programme Nyheter" {
+		t.Fatalf("Unexpected summary: %q", s)
+	}
+}
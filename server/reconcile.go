@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+// replacer is a playlist whose tracks can be replaced in one operation.
+type replacer interface {
+	Replace(tracks []spotify.Track) error
+}
+
+// Reconciliation is the difference between a playlist and the tracks the sync
+// would have kept in it.
+type Reconciliation struct {
+	// Tracks are the tracks of the playlist, in playlist order
+	Tracks []spotify.Track
+	// Duplicates are the repeated occurrences of tracks
+	Duplicates []spotify.Track
+	// Excess are the oldest tracks beyond the cache size
+	Excess []spotify.Track
+	// Foreign are the tracks which were not played on the radio. They are
+	// only known when reconciling with a history
+	Foreign []spotify.Track
+	// Missing are the played tracks within the cache size which are not in
+	// the playlist
+	Missing []spotify.Track
+	// Unordered is true if the tracks are not in the order they were last
+	// played
+	Unordered bool
+	// Expected are the tracks the playlist should contain, in order
+	Expected []spotify.Track
+}
+
+// OK returns true if the playlist contains exactly the expected tracks.
+func (r *Reconciliation) OK() bool {
+	return len(r.Duplicates) == 0 && len(r.Excess) == 0 &&
+		len(r.Foreign) == 0 && len(r.Missing) == 0 && !r.Unordered
+}
+
+func (r *Reconciliation) String() string {
+	s := fmt.Sprintf("duplicates %d, excess %d, foreign %d, missing %d",
+		len(r.Duplicates), len(r.Excess), len(r.Foreign),
+		len(r.Missing))
+	if r.Unordered {
+		s += ", out of order"
+	}
+	return s
+}
+
+// playedTracks returns the Spotify tracks of the music played in source
+// between from and to, ordered by when they were last played.
+func (sync *Sync) playedTracks(source HistorySource, from,
+	to time.Time) ([]spotify.Track, error) {
+	radioTracks, err := sync.retryHistory(source, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sync.log().Info("Searching for played tracks",
+		logger.F("elements", len(radioTracks)))
+	searched := make(map[string][]spotify.Track)
+	tracks := make(map[string]spotify.Track)
+	lastPlayed := make(map[string]int)
+	for i, t := range radioTracks {
+		if !t.IsMusic() {
+			continue
+		}
+		key := t.String()
+		found, ok := searched[key]
+		if !ok {
+			found, err = sync.retrySearch(&t)
+			if err != nil {
+				return nil, err
+			}
+			searched[key] = found
+		}
+		if len(found) == 0 {
+			continue
+		}
+		tracks[found[0].Id] = found[0]
+		lastPlayed[found[0].Id] = i
+	}
+	played := make([]spotify.Track, 0, len(tracks))
+	for _, t := range tracks {
+		played = append(played, t)
+	}
+	sort.Slice(played, func(i, j int) bool {
+		return lastPlayed[played[i].Id] < lastPlayed[played[j].Id]
+	})
+	return played, nil
+}
+
+// openExistingPlaylist opens the playlist, which unlike initPlaylist is not
+// created if it does not exist.
+func (sync *Sync) openExistingPlaylist() error {
+	var found bool
+	err := sync.retry(5*time.Minute, "Get playlist", func() error {
+		var err error
+		found, err = sync.Playlist.OpenExisting()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("playlist %s does not exist", sync.Playlist)
+	}
+	sync.publish(PlaylistOpened{Playlist: sync.Playlist.String()})
+	return nil
+}
+
+// Reconcile compares the playlist with the CacheSize tracks it should
+// contain. If source is nil, those are the last unique tracks of the
+// playlist. Otherwise they are the last tracks played in source between from
+// and to, which are found in Spotify.
+func (sync *Sync) Reconcile(source HistorySource, from,
+	to time.Time) (*Reconciliation, error) {
+	if err := sync.openExistingPlaylist(); err != nil {
+		return nil, err
+	}
+	var tracks []spotify.Track
+	err := sync.retry(5*time.Minute, "Get playlist tracks", func() error {
+		var err error
+		tracks, err = sync.Playlist.Tracks()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &Reconciliation{Tracks: tracks}
+	present := make(map[string]bool, len(tracks))
+	var unique []spotify.Track
+	for _, t := range tracks {
+		if present[t.Id] {
+			r.Duplicates = append(r.Duplicates, t)
+			continue
+		}
+		present[t.Id] = true
+		unique = append(unique, t)
+	}
+
+	expected := unique
+	if source != nil {
+		expected, err = sync.playedTracks(source, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(expected) == 0 {
+			return nil, fmt.Errorf("no played tracks found in %s",
+				source)
+		}
+	}
+	played := make(map[string]bool, len(expected))
+	for _, t := range expected {
+		played[t.Id] = true
+	}
+	if n := len(expected) - sync.CacheSize; sync.CacheSize > 0 && n > 0 {
+		expected = expected[n:]
+	}
+	r.Expected = expected
+	kept := make(map[string]bool, len(expected))
+	for _, t := range expected {
+		kept[t.Id] = true
+		if !present[t.Id] {
+			r.Missing = append(r.Missing, t)
+		}
+	}
+
+	// The tracks to keep should be in the expected order
+	var order []string
+	for _, t := range unique {
+		if !played[t.Id] {
+			r.Foreign = append(r.Foreign, t)
+		} else if !kept[t.Id] {
+			r.Excess = append(r.Excess, t)
+		} else {
+			order = append(order, t.Id)
+		}
+	}
+	var expectedOrder []string
+	for _, t := range expected {
+		if present[t.Id] {
+			expectedOrder = append(expectedOrder, t.Id)
+		}
+	}
+	r.Unordered = strings.Join(order, ",") !=
+		strings.Join(expectedOrder, ",")
+	return r, nil
+}
+
+// Repair replaces the tracks of the playlist with the expected tracks of r.
+func (sync *Sync) Repair(r *Reconciliation) error {
+	if r.OK() {
+		return nil
+	}
+	replacer, ok := sync.Playlist.(replacer)
+	if !ok {
+		return fmt.Errorf("tracks of %s cannot be replaced",
+			sync.Playlist)
+	}
+	if sync.DryRun {
+		sync.log().Info("Would replace playlist tracks",
+			logger.F("playlist", sync.Playlist.String()),
+			logger.F("tracks", len(r.Expected)))
+		return nil
+	}
+	err := sync.retry(time.Minute, "Replace tracks", func() error {
+		return replacer.Replace(r.Expected)
+	})
+	if err != nil {
+		return err
+	}
+	sync.log().Info("Replaced playlist tracks",
+		logger.F("playlist", sync.Playlist.String()),
+		logger.F("tracks", len(r.Expected)))
+	return nil
+}
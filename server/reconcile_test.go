@@ -0,0 +1,176 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/spotify"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func ids(tracks []spotify.Track) []string {
+	ids := make([]string, len(tracks))
+	for i, t := range tracks {
+		ids[i] = t.Id
+	}
+	return ids
+}
+
+func equalIds(tracks []spotify.Track, expected ...string) bool {
+	got := ids(tracks)
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReconcile(t *testing.T) {
+	sync, _, sink := newTestSync(t)
+	sync.CacheSize = 2
+	a := sink.add("Bob Dylan", "Hurricane")
+	b := sink.add("The Band", "The Weight")
+	c := sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.tracks = []spotify.Track{a, b, a, c}
+
+	r, err := sync.Reconcile(nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIds(r.Duplicates, a.Id) || !equalIds(r.Excess, a.Id) ||
+		len(r.Foreign) != 0 || len(r.Missing) != 0 || r.Unordered ||
+		!equalIds(r.Expected, b.Id, c.Id) {
+		t.Fatalf("Unexpected reconciliation: %+v", r)
+	}
+	if err := sync.Repair(r); err != nil {
+		t.Fatal(err)
+	}
+	if !equalIds(sink.tracks, b.Id, c.Id) {
+		t.Fatalf("Expected repaired playlist, got %v", ids(sink.tracks))
+	}
+}
+
+func TestReconcileMissingPlaylist(t *testing.T) {
+	sync, _, sink := newTestSync(t)
+	sink.missing = true
+	_, err := sync.Reconcile(nil, time.Time{}, time.Time{})
+	if err == nil || err.Error() != "playlist NRK P3 does not exist" {
+		t.Fatalf("Expected missing playlist error, got %v", err)
+	}
+}
+
+func TestRepairExistingPlaylist(t *testing.T) {
+	api := spotifytest.NewServer()
+	defer api.Close()
+	a := api.AddTrack("Bob Dylan", "Hurricane")
+	b := api.AddTrack("The Band", "The Weight")
+	api.CreatePlaylist("NRK P3", a, b, a)
+	sync := &Sync{Playlist: api.Sink("NRK P3"), CacheSize: 2}
+
+	r, err := sync.Reconcile(nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(api.Requests())
+	if err := sync.Repair(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.Tracks("NRK P3"); !equalIds(got, a.Id, b.Id) {
+		t.Fatalf("Expected repaired playlist, got %v", ids(got))
+	}
+	// The repaired playlist is read by its ID, and never created
+	for _, req := range api.Requests()[before:] {
+		if req.Path == "/v1/users/gopher/playlists" {
+			t.Fatalf("Unexpected playlist lookup: %+v", req)
+		}
+	}
+	if n := api.Count("POST", "/v1/users/gopher/playlists"); n != 0 {
+		t.Fatalf("Expected no playlist to be created, got %d", n)
+	}
+}
+
+func TestReconcileWithHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	history := &History{File: filepath.Join(dir, "history.jsonl")}
+	err = history.Record(
+		testTrack("The Band", "The Weight", "Music", -20*time.Minute),
+		testTrack("Bob Dylan", "Hurricane", "Music", -16*time.Minute),
+		testTrack("", "Nyheter", "Program", -12*time.Minute),
+		testTrack("The Band", "The Weight", "Music", -8*time.Minute),
+		testTrack("Unknown", "Unknown", "Music", -4*time.Minute),
+		testTrack("Neil Young", "Harvest", "Music", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync, _, sink := newTestSync(t)
+	sync.CacheSize = 3
+	a := sink.add("Bob Dylan", "Hurricane")
+	b := sink.add("The Band", "The Weight")
+	c := sink.add("Neil Young", "Harvest")
+	x := spotify.Track{Id: "x", Name: "Added by hand"}
+	sink.tracks = []spotify.Track{b, x, a, b}
+
+	from, to := testStart.Add(-time.Hour), testStart.Add(time.Hour)
+	r, err := sync.Reconcile(history, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Weight was last played after Hurricane
+	if !equalIds(r.Expected, a.Id, b.Id, c.Id) ||
+		!equalIds(r.Duplicates, b.Id) || len(r.Excess) != 0 ||
+		!equalIds(r.Foreign, x.Id) || !equalIds(r.Missing, c.Id) ||
+		!r.Unordered {
+		t.Fatalf("Unexpected reconciliation: %+v", r)
+	}
+	expected := "duplicates 1, excess 0, foreign 1, missing 1, out of order"
+	if s := r.String(); s != expected {
+		t.Fatalf("Expected %q, got %q", expected, s)
+	}
+
+	// Nothing is changed in a dry run
+	sync.DryRun = true
+	if err := sync.Repair(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.tracks) != 4 {
+		t.Fatalf("Expected unchanged playlist, got %v",
+			ids(sink.tracks))
+	}
+
+	sync.DryRun = false
+	if err := sync.Repair(r); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = sync.Reconcile(history, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("Expected reconciled playlist, got %s", r)
+	}
+
+	// The oldest played tracks are excess when the cache is smaller
+	sync.CacheSize = 2
+	if r, err = sync.Reconcile(history, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if !equalIds(r.Excess, a.Id) || r.Unordered {
+		t.Fatalf("Unexpected reconciliation: %+v", r)
+	}
+
+	_, err = sync.Reconcile(history, to, to.Add(time.Hour))
+	if err == nil {
+		t.Fatal("Expected error for empty history")
+	}
+}
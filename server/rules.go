@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+// scheduleWindow is how far ahead the schedule is fetched.
+const scheduleWindow = 24 * time.Hour
+
+var errSkipped = errors.New("programme is skipped")
+
+// Rule applies to music played during programmes titled Title.
+type Rule struct {
+	Title string
+	// Playlist receives the music of the programme instead of the default
+	// playlist, if set
+	Playlist PlaylistSink
+	// Skip disables syncing while the programme is on air, without polling
+	// the radio
+	Skip bool
+}
+
+type ruleConfig struct {
+	Programme string `json:"programme"`
+	Playlist  string `json:"playlist"`
+	Skip      bool   `json:"skip"`
+}
+
+// ReadRules reads rules from the JSON file name. Playlists are created by
+// calling newPlaylist with the playlist name.
+func ReadRules(name string,
+	newPlaylist func(name string) PlaylistSink) ([]Rule, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ruleConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	rules := make([]Rule, len(configs))
+	playlists := make(map[string]PlaylistSink)
+	for i, c := range configs {
+		if strings.TrimSpace(c.Programme) == "" {
+			return nil, fmt.Errorf("%s: rule %d: programme is "+
+				"required", name, i+1)
+		}
+		if c.Playlist != "" && c.Skip {
+			return nil, fmt.Errorf("%s: rule %d: playlist and "+
+				"skip are mutually exclusive", name, i+1)
+		}
+		rules[i] = Rule{Title: c.Programme, Skip: c.Skip}
+		if c.Playlist == "" {
+			continue
+		}
+		// Programmes sharing a playlist share the sink, and thereby
+		// the cache
+		if _, ok := playlists[c.Playlist]; !ok {
+			playlists[c.Playlist] = newPlaylist(c.Playlist)
+		}
+		rules[i].Playlist = playlists[c.Playlist]
+	}
+	return rules, nil
+}
+
+// rule returns the first rule for the programme titled title.
+func (sync *Sync) rule(title string) *Rule {
+	if title == "" {
+		return nil
+	}
+	programme := nrk.Programme{Title: title}
+	for i := range sync.Rules {
+		if programme.Is(sync.Rules[i].Title) {
+			return &sync.Rules[i]
+		}
+	}
+	return nil
+}
+
+// playlistFor returns the playlist and cache for music played in the
+// programme of track. errSkipped is returned if the programme is skipped.
+func (sync *Sync) playlistFor(track *nrk.Track) (PlaylistSink, *trackCache,
+	error) {
+	rule := sync.rule(track.Programme)
+	if rule != nil && rule.Skip {
+		return nil, nil, errSkipped
+	}
+	if rule == nil || rule.Playlist == nil {
+		return sync.Playlist, sync.cache, nil
+	}
+	if cache, ok := sync.caches[rule.Playlist]; ok {
+		return rule.Playlist, cache, nil
+	}
+	if err := sync.openPlaylist(rule.Playlist); err != nil {
+		return nil, nil, err
+	}
+	cache, err := sync.newCache(rule.Playlist)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sync.caches == nil {
+		sync.caches = make(map[PlaylistSink]*trackCache)
+	}
+	sync.caches[rule.Playlist] = cache
+	sync.log().Info("Opened programme playlist",
+		logger.F("programme", rule.Title),
+		logger.F("playlist", rule.Playlist.String()))
+	return rule.Playlist, cache, nil
+}
+
+// currentSchedule returns the schedule from now, fetching it if the known
+// schedule does not cover the next hour. The schedule is empty if it cannot
+// be fetched.
+func (sync *Sync) currentSchedule() nrk.Schedule {
+	if sync.Schedule == nil {
+		return nil
+	}
+	now := sync.clock().Now()
+	if sync.schedule.Covers(now, time.Hour) {
+		return sync.schedule
+	}
+	schedule, err := sync.Schedule.Schedule(now.Add(-time.Hour),
+		now.Add(scheduleWindow))
+	if err != nil {
+		sync.publish(ScheduleFailed{Err: err})
+		return sync.schedule
+	}
+	sync.schedule = schedule
+	return schedule
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/nrk/nrktest"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func TestReadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "rules.json")
+	write := func(data string) {
+		err := ioutil.WriteFile(name, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newPlaylist := func(name string) PlaylistSink {
+		sink := newTestSink()
+		sink.name = name
+		return sink
+	}
+
+	write(`[
+  {"programme": "Christine", "playlist": "NRK P3 Christine"},
+  {"programme": "Christine Live", "playlist": "NRK P3 Christine"},
+  {"programme": "Nyheter", "skip": true}
+]`)
+	rules, err := ReadRules(name, newPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(rules))
+	}
+	if rules[0].Playlist == nil ||
+		rules[0].Playlist.String() != "NRK P3 Christine" {
+		t.Fatalf("Expected playlist, got %+v", rules[0])
+	}
+	if rules[0].Playlist != rules[1].Playlist {
+		t.Fatal("Expected rules to share playlist")
+	}
+	if !rules[2].Skip || rules[2].Playlist != nil {
+		t.Fatalf("Expected skip rule, got %+v", rules[2])
+	}
+
+	for _, data := range []string{
+		`{}`,
+		`[{"playlist": "NRK P3"}]`,
+		`[{"programme": "Nyheter", "playlist": "P3", "skip": true}]`,
+	} {
+		write(data)
+		if _, err := ReadRules(name, newPlaylist); err == nil {
+			t.Errorf("Expected error for %s", data)
+		}
+	}
+}
+
+type pollingRadio struct {
+	RadioSource
+	clock clock.Clock
+	polls []time.Time
+}
+
+func (r *pollingRadio) Playlist() (*nrk.Playlist, error) {
+	r.polls = append(r.polls, r.clock.Now())
+	return r.RadioSource.Playlist()
+}
+
+func TestRunProgrammes(t *testing.T) {
+	start := time.Date(2015, 1, 1, 6, 0, 0, 0, time.UTC)
+	// The radio only returns the current and next elements when there is
+	// a previous element
+	clock := clock.NewFake(start.Add(3 * time.Minute))
+	script := nrktest.NewScript(start).
+		Programme("Morgen").
+		Talk("God morgen", 2*time.Minute).
+		Track("Bob Dylan", "Hurricane", 4*time.Minute).
+		Track("Bob Dylan", "Like a Rolling Stone", 4*time.Minute).
+		Programme("Nyheter").
+		Talk("Nyheter", 30*time.Minute).
+		Programme("Christine").
+		Track("The Band", "The Weight", 4*time.Minute).
+		Track("The Band", "Up on Cripple Creek", 4*time.Minute).
+		Programme("Kveld").
+		Track("Neil Young", "Harvest", 4*time.Minute).
+		Track("Neil Young", "Old Man", 4*time.Minute)
+	server := nrktest.NewServer(clock)
+	defer server.Close()
+	server.Play("p3", script)
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.AutoCatalog = true
+
+	nrkRadio := server.Radio("NRK P3", "p3")
+	radio := &pollingRadio{RadioSource: nrkRadio, clock: clock}
+	sync := &Sync{
+		Radio:     radio,
+		Playlist:  api.Sink("NRK P3"),
+		Adaptive:  true,
+		Interval:  5 * time.Minute,
+		CacheSize: 100,
+		Clock:     clock,
+		Schedule:  nrkRadio,
+		Rules: []Rule{
+			{
+				Title:    "christine",
+				Playlist: api.Sink("NRK P3 Christine"),
+			},
+			{Title: "Nyheter", Skip: true},
+		},
+	}
+	if err := sync.initPlaylist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	for clock.Now().Before(script.End()) {
+		<-sync.runForever()
+	}
+
+	expected := map[string][][2]string{
+		"NRK P3": {
+			{"Bob Dylan", "Hurricane"},
+			{"Bob Dylan", "Like a Rolling Stone"},
+			{"Neil Young", "Harvest"},
+			{"Neil Young", "Old Man"},
+		},
+		"NRK P3 Christine": {
+			{"The Band", "The Weight"},
+			{"The Band", "Up on Cripple Creek"},
+		},
+	}
+	for playlist, tracks := range expected {
+		added := api.Tracks(playlist)
+		if len(added) != len(tracks) {
+			t.Fatalf("Expected %d tracks in %s, got %d",
+				len(tracks), playlist, len(added))
+		}
+		for i, track := range tracks {
+			id := api.AddTrack(track[0], track[1]).Id
+			if added[i].Id != id {
+				t.Errorf("Expected %s - %s in %s", track[0],
+					track[1], playlist)
+			}
+		}
+	}
+
+	news := script.Programmes()[1]
+	for _, poll := range radio.polls {
+		if !poll.Before(news.Start) && poll.Before(news.End) {
+			t.Fatalf("Expected no polling during %s, polled at %s",
+				news.Title, poll)
+		}
+	}
+}
+
+func TestRunAdaptiveAllSkipped(t *testing.T) {
+	tracks := []nrk.Track{
+		{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute),
+	}
+	for i := range tracks {
+		tracks[i].Programme = "Nyheter"
+	}
+	sync, _, sink := newTestSync(t, tracks...)
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	sync.Adaptive = true
+	sync.Rules = []Rule{{Title: "Nyheter", Skip: true}}
+
+	duration, err := sync.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != sync.Interval {
+		t.Fatalf("Expected %s, got %s", sync.Interval, duration)
+	}
+	if len(sink.added) != 0 {
+		t.Fatalf("Expected no added tracks, got %v", sink.added)
+	}
+}
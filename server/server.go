@@ -1,141 +1,281 @@
 package server
 
 import (
-	"log"
+	"fmt"
 	"os"
 	"runtime/pprof"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/golang/groupcache/lru"
-	"github.com/mitchellh/colorstring"
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
 	"github.com/mpolden/nrk-spotify/nrk"
 	"github.com/mpolden/nrk-spotify/spotify"
 )
 
-var Colorize colorstring.Colorize
-
-func init() {
-	Colorize = colorstring.Colorize{
-		Colors: colorstring.DefaultColors,
-		Reset:  true,
-	}
-}
+// Log is the logger of syncs without a logger of their own.
+var Log = logger.New(os.Stderr, logger.Text, logger.Info)
 
 type Sync struct {
-	Spotify       *spotify.Spotify
-	Radio         *nrk.Radio
+	Radio         RadioSource
+	Playlist      PlaylistSink
 	Interval      time.Duration
 	Adaptive      bool
 	CacheSize     int
 	DeleteEvicted bool
-	playlist      *spotify.Playlist
-	cache         *lru.Cache
+	cache         *trackCache
 	MemProfile    string
+	Clock         clock.Clock
+	// DryRun logs the tracks which would be added to and deleted from
+	// playlists, instead of changing them
+	DryRun bool
+	// Events receives the activity of the sync, and may be shared by
+	// several syncs. If nil, all events are logged to Logger
+	Events *Bus
+	// Logger defaults to Log
+	Logger   *logger.Logger
+	bus      *Bus
+	recorder *statusRecorder
+	health   *healthRecorder
+	// StaleRuns is the number of intervals without a successful run after
+	// which the sync is no longer ready. Defaults to 3
+	StaleRuns int
+	// Metrics records metrics of the sync, if set
+	Metrics *Metrics
+	// History records played elements, if set
+	History *History
+	// Notifier sends events to webhooks, if set
+	Notifier *Notifier
+	// tokenErr is the last token refresh error seen
+	tokenErr error
+	// Schedule provides the programmes of the radio. Rules are only
+	// applied if set
+	Schedule ScheduleSource
+	Rules    []Rule
+	schedule nrk.Schedule
+	caches   map[PlaylistSink]*trackCache
+	// cacheMu guards cache, which is read when serving status
+	cacheMu sync.Mutex
 }
 
-func logColorf(format string, v ...interface{}) {
-	log.Printf(Colorize.Color(format), v...)
+func (sync *Sync) log() *logger.Logger {
+	if sync.Logger == nil {
+		return Log
+	}
+	return sync.Logger
 }
 
-func (sync *Sync) isCached(track *spotify.Track) bool {
-	_, exists := sync.cache.Get(track.Id)
-	return exists
+func (sync *Sync) clock() clock.Clock {
+	return clock.OrReal(sync.Clock)
 }
 
-func (sync *Sync) addTrack(track *spotify.Track) {
-	if !sync.isCached(track) {
-		sync.cache.Add(track.Id, *track)
+func (sync *Sync) events() *Bus {
+	if sync.bus != nil {
+		return sync.bus
+	}
+	// The recorders of this sync only see its own events, even if Events
+	// is shared
+	bus := NewBus()
+	if sync.Events == nil {
+		bus.Subscribe(EventLogger(sync.log()))
+	} else {
+		bus.Subscribe(sync.Events.Publish)
+	}
+	if sync.History != nil {
+		bus.Subscribe(sync.History.subscriber(bus))
 	}
+	radio := ""
+	if sync.Radio != nil {
+		radio = sync.Radio.String()
+	}
+	sync.recorder = newStatusRecorder(radio)
+	bus.Subscribe(sync.recorder.record)
+	sync.health = &healthRecorder{}
+	bus.Subscribe(sync.health.record)
+	if sync.Metrics != nil {
+		bus.Subscribe(sync.Metrics.record)
+	}
+	if sync.Notifier != nil {
+		bus.Subscribe(sync.Notifier.notify)
+	}
+	sync.bus = bus
+	return bus
 }
 
-func (sync *Sync) initPlaylist() error {
+func (sync *Sync) publish(event Event) {
+	sync.events().Publish(event)
+}
+
+// retry calls fn until it succeeds or maxElapsed has passed, backing off
+// exponentially between attempts.
+func (sync *Sync) retry(maxElapsed time.Duration, what string,
+	fn func() error) error {
 	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(5 * time.Minute)
-	ticker := backoff.NewTicker(b)
-	var playlist *spotify.Playlist
-	var err error
-	for _ = range ticker.C {
-		playlist, err = sync.Spotify.GetOrCreatePlaylist(
-			sync.Radio.Name)
-		if err != nil {
-			log.Printf("Failed to get playlist: %s", err)
-			log.Println("Retrying...")
-			continue
+	b.MaxElapsedTime = maxElapsed
+	b.Clock = sync.clock()
+	b.Reset()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
 		}
-		ticker.Stop()
-		break
-	}
-	if err != nil {
-		return err
+		next := b.NextBackOff()
+		sync.publish(AttemptFailed{
+			Operation: what,
+			Attempt:   attempt,
+			Err:       err,
+			Retry:     next != backoff.Stop,
+			Delay:     next,
+		})
+		if next == backoff.Stop {
+			return err
+		}
+		<-sync.clock().After(next)
 	}
-	sync.playlist = playlist
-	return nil
 }
 
-func (sync *Sync) deleteEvicted(key lru.Key, value interface{}) {
-	track, ok := value.(spotify.Track)
+// indexedPlaylist is a playlist which can tell whether it contains a track,
+// regardless of how many tracks it has.
+type indexedPlaylist interface {
+	Contains(track *spotify.Track) (bool, error)
+}
+
+// inPlaylist returns true if track is in playlist. It is only known for
+// indexed playlists.
+func (sync *Sync) inPlaylist(playlist PlaylistSink,
+	track *spotify.Track) (bool, error) {
+	indexed, ok := playlist.(indexedPlaylist)
 	if !ok {
-		log.Printf("Could not cast to spotify.Track: %+v", value)
-		return
+		return false, nil
 	}
-	if err := sync.retryDeleteTrack(&track); err != nil {
-		log.Printf("Failed to delete track: %s", err)
-		return
+	var found bool
+	err := sync.retry(time.Minute, "Check playlist", func() error {
+		var err error
+		found, err = indexed.Contains(track)
+		return err
+	})
+	return found, err
+}
+
+// openPlaylist opens playlist. A dry run does not create a playlist which
+// does not exist, but syncs as if it were empty.
+func (sync *Sync) openPlaylist(playlist PlaylistSink) error {
+	if !sync.DryRun {
+		return sync.retry(5*time.Minute, "Get playlist", playlist.Open)
 	}
-	logColorf("[dark_gray]Deleted evicted track: %s[reset]", track.String())
+	var found bool
+	err := sync.retry(5*time.Minute, "Get playlist", func() error {
+		var err error
+		found, err = playlist.OpenExisting()
+		return err
+	})
+	if err == nil && !found {
+		sync.log().Info("Would create playlist",
+			logger.F("playlist", playlist.String()))
+	}
+	return err
 }
 
-func (sync *Sync) initCache() error {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(5 * time.Minute)
-	ticker := backoff.NewTicker(b)
-	var tracks []spotify.PlaylistTrack
-	var err error
-	for _ = range ticker.C {
-		tracks, err = sync.Spotify.RecentTracks(sync.playlist,
-			sync.playlist.Tracks.Total)
-		if err != nil {
-			log.Printf("Failed to get recent tracks: %s", err)
-			log.Println("Retrying...")
-			continue
+func (sync *Sync) initPlaylist() error {
+	if err := sync.openPlaylist(sync.Playlist); err != nil {
+		return err
+	}
+	sync.publish(PlaylistOpened{Playlist: sync.Playlist.String()})
+	return nil
+}
+
+// deleteEvicted returns a function which deletes evicted tracks from
+// playlist.
+func (sync *Sync) deleteEvicted(playlist PlaylistSink) func(spotify.Track) {
+	return func(track spotify.Track) {
+		if err := sync.retryDeleteTrack(playlist, &track); err != nil {
+			sync.publish(EvictFailed{
+				Spotify:  track,
+				Playlist: playlist.String(),
+				Err:      err,
+			})
+			return
 		}
-		ticker.Stop()
-		break
+		sync.publish(TrackEvicted{
+			Spotify:  track,
+			Playlist: playlist.String(),
+			DryRun:   sync.DryRun,
+		})
 	}
-	if err != nil {
+}
+
+// newCache returns a cache of the tracks in playlist.
+func (sync *Sync) newCache(playlist PlaylistSink) (*trackCache, error) {
+	var tracks []spotify.Track
+	err := sync.retry(5*time.Minute, "Get playlist tracks", func() error {
+		var err error
+		tracks, err = playlist.Tracks()
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	sync.cache = lru.New(sync.CacheSize)
+	var onEvicted func(spotify.Track)
 	if sync.DeleteEvicted {
-		log.Print("Deleting evicted tracks from playlist")
-		sync.cache.OnEvicted = sync.deleteEvicted
+		onEvicted = sync.deleteEvicted(playlist)
 	}
+	cache := newTrackCache(sync.CacheSize, onEvicted)
 	for _, t := range tracks {
-		sync.addTrack(&t.Track)
+		cache.Add(&t)
 	}
+	return cache, nil
+}
+
+func (sync *Sync) initCache() error {
+	if sync.DeleteEvicted {
+		sync.log().Info("Deleting evicted tracks from playlist")
+	}
+	cache, err := sync.newCache(sync.Playlist)
+	if err != nil {
+		return err
+	}
+	sync.cacheMu.Lock()
+	sync.cache = cache
+	sync.cacheMu.Unlock()
 	return nil
 }
 
-func (sync *Sync) Serve() {
-	log.Printf("Server started")
+// currentCache returns the cache of the default playlist, or nil if it has
+// not been initialized.
+func (sync *Sync) currentCache() *trackCache {
+	sync.cacheMu.Lock()
+	defer sync.cacheMu.Unlock()
+	return sync.cache
+}
 
-	log.Print("Initializing Spotify playlist")
+// Init opens the playlist and fills the cache with its tracks.
+func (sync *Sync) Init() error {
+	log := sync.log()
+	if sync.DryRun {
+		log.Info("Dry run, playlists will not be changed")
+	}
+	log.Info("Initializing Spotify playlist")
 	if err := sync.initPlaylist(); err != nil {
-		log.Fatalf("Failed to initialize playlist: %s", err)
+		return fmt.Errorf("failed to initialize playlist: %s", err)
 	}
-	log.Printf("Playlist: %s", sync.playlist.String())
 
-	log.Print("Initializing cache")
+	log.Info("Initializing cache")
 	if err := sync.initCache(); err != nil {
-		log.Fatalf("Failed to init cache: %s", err)
+		return fmt.Errorf("failed to initialize cache: %s", err)
 	}
-	log.Printf("Size: %d/%d", sync.cache.Len(), sync.cache.MaxEntries)
+	log.Info("Initialized cache", logger.F("cache_size", sync.cache.Len()),
+		logger.F("cache_max", sync.cache.Max()))
+	return nil
+}
 
+// Run syncs until the process exits. The sync must be initialized.
+func (sync *Sync) Run() {
 	if sync.Adaptive {
-		log.Print("Using adaptive interval")
+		sync.log().Info("Using adaptive interval")
 	} else {
-		log.Printf("Syncing every %s", sync.Interval)
+		sync.log().Info("Using fixed interval",
+			logger.F("interval", sync.Interval))
 	}
 	for {
 		select {
@@ -144,6 +284,16 @@ func (sync *Sync) Serve() {
 	}
 }
 
+// Serve initializes the sync and runs it, exiting if initialization fails.
+func (sync *Sync) Serve() {
+	sync.log().Info("Server started")
+	if err := sync.Init(); err != nil {
+		sync.log().Fatal("Failed to initialize server",
+			logger.F("error", err))
+	}
+	sync.Run()
+}
+
 func (sync *Sync) memProfile() error {
 	f, err := os.Create(sync.MemProfile)
 	if err != nil {
@@ -156,165 +306,238 @@ func (sync *Sync) memProfile() error {
 	return nil
 }
 
-func (sync *Sync) runForever() <-chan time.Time {
+// checkToken publishes TokenRefreshFailed when the token refresh of the
+// playlist starts failing, or fails with a different error.
+func (sync *Sync) checkToken() {
+	refresher, ok := sync.Playlist.(refresher)
+	if !ok {
+		return
+	}
+	err := refresher.RefreshError()
+	if err != nil && (sync.tokenErr == nil ||
+		err.Error() != sync.tokenErr.Error()) {
+		sync.publish(TokenRefreshFailed{Err: err})
+	}
+	sync.tokenErr = err
+}
+
+// runOnce runs the sync and publishes the outcome. It returns the duration
+// until the next run, and the error of the run, if any.
+func (sync *Sync) runOnce() (time.Duration, error) {
+	started := sync.clock().Now()
 	duration, err := sync.run()
+	sync.checkToken()
+	now := sync.clock().Now()
 	if err != nil {
-		log.Printf("Sync failed: %s", err)
+		sync.publish(RunFailed{Time: now, Err: err})
 		duration = sync.Interval
 	}
-	log.Printf("Next sync in %s", duration)
+	sync.publish(RunFinished{
+		Time:      now,
+		Duration:  now.Sub(started),
+		Next:      duration,
+		CacheSize: sync.cache.Len(),
+		CacheMax:  sync.cache.Max(),
+	})
 	if sync.MemProfile != "" {
-		log.Printf("Writing memory profile to: %s", sync.MemProfile)
+		sync.log().Debug("Writing memory profile",
+			logger.F("file", sync.MemProfile))
 		if err := sync.memProfile(); err != nil {
-			log.Print(err)
+			sync.log().Error("Failed to write memory profile",
+				logger.F("error", err))
 		}
 	}
-	return time.After(duration)
+	return duration, err
+}
+
+func (sync *Sync) runForever() <-chan time.Time {
+	duration, _ := sync.runOnce()
+	return sync.clock().After(duration)
 }
 
 func (sync *Sync) retryPlaylist() (*nrk.Playlist, error) {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(1 * time.Minute)
-	ticker := backoff.NewTicker(b)
 	var playlist *nrk.Playlist
-	var err error
-	for _ = range ticker.C {
-		playlist, err = sync.Radio.Playlist()
-		if err != nil {
-			log.Printf("Retrieving radio playlist failed: %s", err)
-			log.Println("Retrying...")
-			continue
-		}
-		ticker.Stop()
-		break
-	}
+	err := sync.retry(time.Minute, "Retrieving radio playlist",
+		func() error {
+			var err error
+			playlist, err = sync.Radio.Playlist()
+			return err
+		})
 	return playlist, err
 }
 
 func (sync *Sync) retrySearch(track *nrk.Track) ([]spotify.Track, error) {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(1 * time.Minute)
-	ticker := backoff.NewTicker(b)
 	var tracks []spotify.Track
-	var err error
-	for _ = range ticker.C {
-		tracks, err = sync.Spotify.SearchArtistTrack(
-			track.ArtistName(), track.Track)
-		if err != nil {
-			log.Printf("Search failed: %s", err)
-			log.Println("Retrying...")
-			continue
-		}
-		ticker.Stop()
-		break
-	}
+	err := sync.retry(time.Minute, "Search", func() error {
+		var err error
+		tracks, err = sync.Playlist.Search(track.ArtistName(),
+			track.Track)
+		return err
+	})
 	return tracks, err
 }
 
-func (sync *Sync) retryAddTrack(track *spotify.Track) error {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(1 * time.Minute)
-	ticker := backoff.NewTicker(b)
-	var err error
-	for _ = range ticker.C {
-		err = sync.Spotify.AddTrack(sync.playlist, track)
-		if err != nil {
-			log.Printf("Add track failed: %s", err)
-			log.Println("Retrying...")
-			continue
-		}
-		ticker.Stop()
-		break
+func (sync *Sync) retryAddTrack(playlist PlaylistSink,
+	track *spotify.Track) error {
+	if sync.DryRun {
+		return nil
 	}
-	return err
+	return sync.retry(time.Minute, "Add track", func() error {
+		return playlist.Add(track)
+	})
 }
 
-func (sync *Sync) retryDeleteTrack(track *spotify.Track) error {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = time.Duration(1 * time.Minute)
-	ticker := backoff.NewTicker(b)
-	var err error
-	for _ = range ticker.C {
-		err = sync.Spotify.DeleteTrack(sync.playlist, track)
-		if err != nil {
-			log.Printf("Delete track failed: %s", err)
-			log.Println("Retrying...")
-			continue
-		}
-		ticker.Stop()
-		break
+func (sync *Sync) retryDeleteTrack(playlist PlaylistSink,
+	track *spotify.Track) error {
+	if sync.DryRun {
+		return nil
 	}
-	return err
+	return sync.retry(time.Minute, "Delete track", func() error {
+		return playlist.Delete(track)
+	})
 }
 
-func (sync *Sync) logCurrentTrack(playlist *nrk.Playlist) {
+func (sync *Sync) publishCurrentTrack(playlist *nrk.Playlist) {
 	current, err := playlist.Current()
 	if err != nil {
-		logColorf("[red]Failed to get current track: %s[reset]", err)
+		sync.publish(NowPlayingFailed{Err: err})
 		return
 	}
-	position, err := current.Position()
+	position, err := playlist.Position(current)
 	if err != nil {
-		logColorf("[red]Failed to parse metadata: %s[reset]", err)
+		sync.publish(NowPlayingFailed{Err: err})
 		return
 	}
-	logColorf("[cyan]%s is currently playing: %s - %s[reset] (%s) [%s]",
-		sync.Radio.Name, current.Artist, current.Track,
-		position.String(), position.Symbol(10, !Colorize.Disable))
+	event := NowPlaying{
+		Radio:    sync.Radio.String(),
+		Track:    *current,
+		Position: position,
+	}
+	if next, err := playlist.Next(); err == nil {
+		event.Next = next
+	}
+	sync.publish(event)
+}
+
+// publishPlayed publishes the elements in playlist which have started.
+func (sync *Sync) publishPlayed(playlist *nrk.Playlist) {
+	now := sync.clock().Now()
+	played := []nrk.Track{}
+	for _, t := range playlist.Tracks {
+		start, err := t.StartTime()
+		if err != nil || start.After(now) {
+			continue
+		}
+		played = append(played, t)
+	}
+	sync.publish(Played{Tracks: played})
 }
 
 func (sync *Sync) run() (time.Duration, error) {
-	logColorf("[light_magenta]Running sync[reset]")
+	sync.publish(RunStarted{Time: sync.clock().Now()})
+
+	schedule := sync.currentSchedule()
+	now := sync.clock().Now()
+	if programme := schedule.At(now); programme != nil {
+		sync.publish(ProgrammeOnAir{Programme: *programme})
+		rule := sync.rule(programme.Title)
+		if rule != nil && rule.Skip {
+			sync.publish(ProgrammeSkipped{Programme: *programme})
+			return programme.End.Sub(now), nil
+		}
+	}
 
 	radioPlaylist, err := sync.retryPlaylist()
 	if err != nil {
 		return time.Duration(0), err
 	}
-	sync.logCurrentTrack(radioPlaylist)
+	schedule.Tag(radioPlaylist.Tracks)
+	sync.publishCurrentTrack(radioPlaylist)
+	sync.publishPlayed(radioPlaylist)
 
 	radioTracks, err := radioPlaylist.CurrentAndNext()
 	if err != nil {
 		return time.Duration(0), err
 	}
 	added := make([]nrk.Track, 0, len(radioTracks))
+	skipped := 0
 	for _, t := range radioTracks {
-		logColorf("Searching for: %s", t.String())
+		sync.publish(Searching{Track: t})
 		if !t.IsMusic() {
-			logColorf("[yellow]Not music, skipping: %s[reset]",
-				t.String())
+			sync.publish(NotMusic{Track: t})
+			continue
+		}
+		playlist, cache, err := sync.playlistFor(&t)
+		if err == errSkipped {
+			sync.publish(TrackSkipped{Track: t})
+			skipped++
+			continue
+		}
+		if err != nil {
+			sync.publish(PlaylistFailed{
+				Programme: t.Programme,
+				Err:       err,
+			})
 			continue
 		}
 		tracks, err := sync.retrySearch(&t)
 		if err != nil {
-			logColorf("[red]Search failed: %s (%s)[reset]",
-				t.String(), err)
+			sync.publish(SearchFailed{Track: t, Err: err})
 			continue
 		}
 		if len(tracks) == 0 {
-			logColorf("[yellow]Track not found: %s[reset]",
-				t.String())
+			sync.publish(SearchMiss{Track: t})
 			continue
 		}
 		track := &tracks[0]
-		if sync.isCached(track) {
-			logColorf("[yellow]Already added: %s[reset]",
-				track.String())
+		present := cache.Contains(track)
+		if !present {
+			// The track may have been evicted from the cache, or
+			// added by someone else
+			present, err = sync.inPlaylist(playlist, track)
+			if err != nil {
+				sync.publish(AddFailed{
+					Track:    t,
+					Spotify:  *track,
+					Playlist: playlist.String(),
+					Err:      err,
+				})
+				continue
+			}
+			if present {
+				cache.Add(track)
+			}
+		}
+		if present {
+			sync.publish(AlreadyAdded{
+				Track:    t,
+				Spotify:  *track,
+				Playlist: playlist.String(),
+			})
 			added = append(added, t)
 			continue
 		}
-		if err = sync.retryAddTrack(track); err != nil {
-			logColorf("[red]Failed to add: %s (%s)[reset]",
-				track.String(), err)
+		if err = sync.retryAddTrack(playlist, track); err != nil {
+			sync.publish(AddFailed{
+				Track:    t,
+				Spotify:  *track,
+				Playlist: playlist.String(),
+				Err:      err,
+			})
 			continue
 		}
-		sync.addTrack(track)
+		cache.Add(track)
 		added = append(added, t)
-
-		logColorf("[green]Added track: %s[reset]", track.String())
+		sync.publish(TrackAdded{
+			Track:    t,
+			Spotify:  *track,
+			Playlist: playlist.String(),
+			Default:  playlist == sync.Playlist,
+			DryRun:   sync.DryRun,
+		})
 	}
-	log.Printf("Cache size: %d/%d", sync.cache.Len(),
-		sync.cache.MaxEntries)
-	if !sync.Adaptive {
+	// Nothing to adapt to if all music was skipped by a rule
+	if !sync.Adaptive || (len(added) == 0 && skipped > 0) {
 		return sync.Interval, nil
 	}
 	return radioPlaylist.NextSync(added)
@@ -0,0 +1,487 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/nrk/nrktest"
+	"github.com/mpolden/nrk-spotify/spotify"
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func TestMain(m *testing.M) {
+	Log = logger.New(ioutil.Discard, logger.Text, logger.Debug)
+	os.Exit(m.Run())
+}
+
+func TestSimulatedDay(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clock.NewFake(start)
+	radio := nrktest.NewServer(clock)
+	defer radio.Close()
+	day := nrktest.Day(start)
+	radio.Play("p3", day)
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.AutoCatalog = true
+
+	sync := Sync{
+		Radio:     radio.Radio("NRK P3", "p3"),
+		Playlist:  api.Sink("NRK P3"),
+		Interval:  5 * time.Minute,
+		Adaptive:  true,
+		CacheSize: 1000,
+		Clock:     clock,
+	}
+	if err := sync.initPlaylist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	for clock.Now().Before(day.End()) {
+		<-sync.runForever()
+		runs++
+	}
+
+	music := 0
+	for _, e := range day.Elements() {
+		if e.Type == "Music" {
+			music++
+		}
+	}
+	tracks := api.Tracks("NRK P3")
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		if seen[track.Id] {
+			t.Fatalf("Track added more than once: %s",
+				track.String())
+		}
+		seen[track.Id] = true
+	}
+	t.Logf("%d runs added %d of %d tracks", runs, len(tracks), music)
+	if len(tracks) < music*9/10 {
+		t.Fatalf("Expected at least 90%% of %d tracks to be added, "+
+			"got %d", music, len(tracks))
+	}
+	// Adaptive sync should need far fewer runs than a fixed interval
+	if runs >= 24*60/5 {
+		t.Fatalf("Expected fewer than %d runs, got %d", 24*60/5, runs)
+	}
+}
+
+type testRadio struct {
+	playlist *nrk.Playlist
+	err      error
+	calls    int
+}
+
+func (r *testRadio) String() string { return "NRK P3" }
+
+func (r *testRadio) Playlist() (*nrk.Playlist, error) {
+	r.calls++
+	return r.playlist, r.err
+}
+
+type testSink struct {
+	name     string
+	catalog  map[string]spotify.Track
+	tracks   []spotify.Track
+	added    []spotify.Track
+	deleted  []spotify.Track
+	addErr   error
+	opened   bool
+	missing  bool
+	searches int
+}
+
+func newTestSink() *testSink {
+	return &testSink{catalog: make(map[string]spotify.Track)}
+}
+
+func (s *testSink) String() string {
+	if s.name == "" {
+		return "NRK P3"
+	}
+	return s.name
+}
+
+func (s *testSink) Open() error {
+	s.opened = true
+	return nil
+}
+
+func (s *testSink) OpenExisting() (bool, error) {
+	if s.missing {
+		return false, nil
+	}
+	s.opened = true
+	return true, nil
+}
+
+func (s *testSink) Tracks() ([]spotify.Track, error) {
+	return s.tracks, nil
+}
+
+func (s *testSink) Search(artist string, track string) ([]spotify.Track,
+	error) {
+	s.searches++
+	if t, ok := s.catalog[artist+" - "+track]; ok {
+		return []spotify.Track{t}, nil
+	}
+	return []spotify.Track{}, nil
+}
+
+func (s *testSink) Add(track *spotify.Track) error {
+	if s.addErr != nil {
+		return s.addErr
+	}
+	s.added = append(s.added, *track)
+	return nil
+}
+
+func (s *testSink) Delete(track *spotify.Track) error {
+	s.deleted = append(s.deleted, *track)
+	return nil
+}
+
+func (s *testSink) Replace(tracks []spotify.Track) error {
+	s.tracks = append([]spotify.Track(nil), tracks...)
+	return nil
+}
+
+func (s *testSink) add(artist, name string) spotify.Track {
+	track := spotify.Track{
+		Id:   name,
+		Name: name,
+		Uri:  "spotify:track:" + name,
+	}
+	s.catalog[artist+" - "+name] = track
+	return track
+}
+
+var testStart = time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testTrack(artist, title, typ string, offset time.Duration) nrk.Track {
+	start := testStart.Add(offset)
+	return nrk.Track{
+		Artist:     artist,
+		Track:      title,
+		Type:       typ,
+		StartTime_: fmt.Sprintf("/Date(%d+0000)/", start.Unix()*1000),
+		Duration_:  "PT4M",
+	}
+}
+
+func newTestSync(t *testing.T, tracks ...nrk.Track) (*Sync, *testRadio,
+	*testSink) {
+	sync, radio, sink := newUninitializedSync(tracks...)
+	initTestSync(t, sync)
+	return sync, radio, sink
+}
+
+// newUninitializedSync returns a sync which must be initialized with
+// initTestSync after setting any optional fields.
+func newUninitializedSync(tracks ...nrk.Track) (*Sync, *testRadio,
+	*testSink) {
+	clock := clock.NewFake(testStart.Add(time.Minute))
+	radio := &testRadio{
+		playlist: &nrk.Playlist{Tracks: tracks, Clock: clock},
+	}
+	sink := newTestSink()
+	sync := &Sync{
+		Radio:     radio,
+		Playlist:  sink,
+		Interval:  5 * time.Minute,
+		CacheSize: 10,
+		Clock:     clock,
+		Events:    NewBus(),
+	}
+	return sync, radio, sink
+}
+
+func initTestSync(t *testing.T, sync *Sync) {
+	if err := sync.initPlaylist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	a := sink.add("Bob Dylan", "Like a Rolling Stone")
+	b := sink.add("The Band", "The Weight")
+	if !sink.opened {
+		t.Fatal("Expected playlist to be opened")
+	}
+
+	duration, err := sync.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != sync.Interval {
+		t.Fatalf("Expected %s, got %s", sync.Interval, duration)
+	}
+	if len(sink.added) != 2 || sink.added[0] != a || sink.added[1] != b {
+		t.Fatalf("Expected [%v %v], got %v", a, b, sink.added)
+	}
+
+	// Cached tracks are not added again
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 2 {
+		t.Fatalf("Expected 2 added tracks, got %d", len(sink.added))
+	}
+}
+
+func TestDryRunMissingPlaylist(t *testing.T) {
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.AddTrack("Bob Dylan", "Like a Rolling Stone")
+	sync, _, _ := newUninitializedSync(
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("Dagsnytt", "Nyheter", "Talk", 4*time.Minute))
+	sync.Playlist = api.Sink("Brand new")
+	sync.DryRun = true
+	var added []TrackAdded
+	sync.Events.Subscribe(func(event Event) {
+		if e, ok := event.(TrackAdded); ok {
+			added = append(added, e)
+		}
+	})
+
+	// The missing playlist is empty, and is not created
+	if err := sync.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || !added[0].DryRun {
+		t.Fatalf("Expected 1 track added in a dry run, got %+v", added)
+	}
+	if n := api.Count("POST", "/v1/users/gopher/playlists"); n != 0 {
+		t.Fatalf("Expected no playlist to be created, got %d", n)
+	}
+}
+
+func TestRunAdaptive(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.add("The Band", "The Weight")
+	sync.Adaptive = true
+
+	duration, err := sync.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 minutes remaining of current track, and 4 minutes of next
+	if expected := 7 * time.Minute; duration != expected {
+		t.Fatalf("Expected %s, got %s", expected, duration)
+	}
+}
+
+func TestRunSkipsNotFoundAndNonMusic(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		nrk.Track{},
+		testTrack("", "Nyheter", "Program", 0),
+		testTrack("Unknown", "Unknown", "Music", 4*time.Minute))
+
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 0 {
+		t.Fatalf("Expected no added tracks, got %v", sink.added)
+	}
+	if sink.searches != 1 {
+		t.Fatalf("Expected 1 search, got %d", sink.searches)
+	}
+}
+
+func TestRunAddFailure(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		nrk.Track{})
+	a := sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.addErr = fmt.Errorf("gopher says no")
+
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if sync.cache.Contains(&a) {
+		t.Fatal("Expected failed track to not be cached")
+	}
+	// Track is added on the next run
+	sink.addErr = nil
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 1 || sink.added[0] != a {
+		t.Fatalf("Expected [%v], got %v", a, sink.added)
+	}
+}
+
+// indexedSink is a sink which knows all tracks of its playlist.
+type indexedSink struct {
+	*testSink
+	playlist []spotify.Track
+	err      error
+}
+
+func (s *indexedSink) Contains(track *spotify.Track) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	for _, t := range s.playlist {
+		if t.Id == track.Id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestRunIndexedPlaylist(t *testing.T) {
+	sync, _, sink := newUninitializedSync(
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	a := sink.add("Bob Dylan", "Like a Rolling Stone")
+	b := sink.add("The Band", "The Weight")
+	// Track a has been evicted from the cache, but is still in the
+	// playlist
+	indexed := &indexedSink{testSink: sink, playlist: []spotify.Track{a}}
+	sync.Playlist = indexed
+	initTestSync(t, sync)
+
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 1 || sink.added[0] != b {
+		t.Fatalf("Expected [%v], got %v", b, sink.added)
+	}
+	if !sync.cache.Contains(&a) {
+		t.Fatal("Expected track in playlist to be cached")
+	}
+
+	// Tracks are not added if the playlist cannot be checked
+	sink.added = nil
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	indexed.err = fmt.Errorf("gopher says no")
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 0 {
+		t.Fatalf("Expected no added tracks, got %v", sink.added)
+	}
+}
+
+func TestRunRadioFailure(t *testing.T) {
+	sync, radio, _ := newTestSync(t)
+	radio.err = fmt.Errorf("gopher says no")
+
+	if _, err := sync.run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if radio.calls < 2 {
+		t.Fatalf("Expected radio playlist to be retried, got %d calls",
+			radio.calls)
+	}
+	// Too few tracks
+	radio.err = nil
+	radio.playlist.Tracks = []nrk.Track{{}}
+	if _, err := sync.run(); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestDeleteEvicted(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.tracks = []spotify.Track{{Id: "1"}, {Id: "2"}, {Id: "3"}}
+	sync.CacheSize = 3
+	sync.DeleteEvicted = true
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.add("The Band", "The Weight")
+
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.deleted) != 2 || sink.deleted[0].Id != "1" ||
+		sink.deleted[1].Id != "2" {
+		t.Fatalf("Expected tracks 1 and 2 to be deleted, got %v",
+			sink.deleted)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		nrk.Track{},
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.tracks = []spotify.Track{{Id: "1"}, {Id: "2"}}
+	sync.CacheSize = 2
+	sync.DeleteEvicted = true
+	sync.DryRun = true
+	if err := sync.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	sink.add("The Band", "The Weight")
+	var added, evicted []string
+	sync.Events.Subscribe(func(e Event) {
+		switch e := e.(type) {
+		case TrackAdded:
+			if e.DryRun {
+				added = append(added, e.Spotify.Id)
+			}
+		case TrackEvicted:
+			if e.DryRun {
+				evicted = append(evicted, e.Spotify.Id)
+			}
+		}
+	})
+
+	if _, err := sync.run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.added) != 0 || len(sink.deleted) != 0 {
+		t.Fatalf("Expected playlist to be unchanged, got %v added and "+
+			"%v deleted", sink.added, sink.deleted)
+	}
+	if len(added) != 2 || len(evicted) != 2 || evicted[0] != "1" {
+		t.Fatalf("Expected 2 dry run adds and evictions, got %v and %v",
+			added, evicted)
+	}
+	if sink.searches != 2 {
+		t.Fatalf("Expected 2 searches, got %d", sink.searches)
+	}
+	if recent := sync.Status().Recent; len(recent) != 2 ||
+		recent[0].Result != "would_add" {
+		t.Fatalf("Expected would_add results, got %+v", recent)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"time"
+
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+// RadioSource provides what is playing now and next.
+type RadioSource interface {
+	String() string
+	Playlist() (*nrk.Playlist, error)
+}
+
+// HistorySource provides the elements played in a past time window, in
+// broadcast order.
+type HistorySource interface {
+	String() string
+	History(from, to time.Time) ([]nrk.Track, error)
+}
+
+// ScheduleSource provides the programmes on air in a time window.
+type ScheduleSource interface {
+	Schedule(from, to time.Time) (nrk.Schedule, error)
+}
+
+// PlaylistSink is a playlist that can be read, appended to and deleted from,
+// and which can find tracks to add.
+type PlaylistSink interface {
+	String() string
+	Open() error
+	OpenExisting() (bool, error)
+	Tracks() ([]spotify.Track, error)
+	Search(artist string, track string) ([]spotify.Track, error)
+	Add(track *spotify.Track) error
+	Delete(track *spotify.Track) error
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/nrk"
+)
+
+// TrackStatus is a radio element.
+type TrackStatus struct {
+	Artist    string     `json:"artist"`
+	Title     string     `json:"title"`
+	Type      string     `json:"type"`
+	Programme string     `json:"programme,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// Duration and Position are in seconds
+	Duration float64  `json:"duration,omitempty"`
+	Position *float64 `json:"position,omitempty"`
+}
+
+// NowStatus is what the radio is playing.
+type NowStatus struct {
+	Radio   string       `json:"radio"`
+	Current *TrackStatus `json:"current,omitempty"`
+	Next    *TrackStatus `json:"next,omitempty"`
+	Updated time.Time    `json:"updated"`
+}
+
+// RunStatus is the result of a sync run.
+type RunStatus struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Added    int        `json:"added"`
+	Present  int        `json:"already_added"`
+	Misses   int        `json:"misses"`
+	Failures int        `json:"failures"`
+}
+
+// maxRecent is the number of search results kept in the status.
+const maxRecent = 10
+
+// MatchStatus is the result of searching for a radio element in Spotify.
+type MatchStatus struct {
+	// Time is when the run which searched for the element started
+	Time     time.Time `json:"time"`
+	Track    string    `json:"track"`
+	Spotify  string    `json:"spotify,omitempty"`
+	Playlist string    `json:"playlist,omitempty"`
+	// Result is one of added, would_add, already_added, not_found and
+	// failed
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CachedTrack is a track in the cache.
+type CachedTrack struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+// CacheStatus is the contents of the cache of the default playlist.
+type CacheStatus struct {
+	Size   int           `json:"size"`
+	Max    int           `json:"max"`
+	Tracks []CachedTrack `json:"tracks"`
+}
+
+// PlaylistStatus is the playlist synced to.
+type PlaylistStatus struct {
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Status is the state of a running sync.
+type Status struct {
+	Now      *NowStatus                `json:"now,omitempty"`
+	LastRun  *RunStatus                `json:"last_run,omitempty"`
+	NextSync *time.Time                `json:"next_sync,omitempty"`
+	Recent   []MatchStatus             `json:"recent"`
+	Cache    CacheStatus               `json:"cache"`
+	Errors   map[string]map[string]int `json:"errors"`
+	Playlist PlaylistStatus            `json:"playlist"`
+}
+
+// linkedPlaylist is a playlist which can be linked to.
+type linkedPlaylist interface {
+	ID() string
+	URL() string
+}
+
+// statusRecorder keeps the state of a sync, as seen through its events.
+type statusRecorder struct {
+	mu       sync.Mutex
+	radio    string
+	now      *NowStatus
+	run      *RunStatus
+	lastRun  *RunStatus
+	nextSync *time.Time
+	// recent is the latest search results, newest first
+	recent []MatchStatus
+	errors map[string]map[string]int
+}
+
+func newStatusRecorder(radio string) *statusRecorder {
+	return &statusRecorder{
+		radio:  radio,
+		errors: make(map[string]map[string]int),
+	}
+}
+
+func trackStatus(track *nrk.Track) *TrackStatus {
+	status := &TrackStatus{
+		Artist:    track.Artist,
+		Title:     track.Track,
+		Type:      track.Type,
+		Programme: track.Programme,
+	}
+	if start, err := track.StartTime(); err == nil {
+		status.StartTime = &start
+	}
+	if duration, err := track.Duration(); err == nil {
+		status.Duration = duration.Seconds()
+	}
+	return status
+}
+
+func (r *statusRecorder) countError(event Event) {
+	errors, ok := r.errors[r.radio]
+	if !ok {
+		errors = make(map[string]int)
+		r.errors[r.radio] = errors
+	}
+	errors[event.Name()]++
+}
+
+// failed counts a failure to sync an element.
+func (r *statusRecorder) failed(event Event) {
+	if r.run != nil {
+		r.run.Failures++
+	}
+	r.countError(event)
+}
+
+func (r *statusRecorder) match(track nrk.Track, result string) *MatchStatus {
+	m := MatchStatus{Track: track.String(), Result: result}
+	if r.run != nil {
+		m.Time = r.run.Started
+	}
+	r.recent = append([]MatchStatus{m}, r.recent...)
+	if len(r.recent) > maxRecent {
+		r.recent = r.recent[:maxRecent]
+	}
+	return &r.recent[0]
+}
+
+func (r *statusRecorder) record(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e := event.(type) {
+	case RunStarted:
+		r.run = &RunStatus{Started: e.Time}
+	case RunFailed:
+		if r.run != nil {
+			r.run.Error = e.Err.Error()
+		}
+		r.countError(event)
+	case RunFinished:
+		if r.run != nil {
+			finished := e.Time
+			r.run.Finished = &finished
+			r.lastRun = r.run
+			r.run = nil
+		}
+		next := e.Time.Add(e.Next)
+		r.nextSync = &next
+	case NowPlaying:
+		current := trackStatus(&e.Track)
+		position := e.Position.Position.Seconds()
+		current.Position = &position
+		r.now = &NowStatus{Radio: e.Radio, Current: current}
+		if r.run != nil {
+			r.now.Updated = r.run.Started
+		}
+		if e.Next != nil {
+			r.now.Next = trackStatus(e.Next)
+		}
+	case TrackAdded:
+		if r.run != nil {
+			r.run.Added++
+		}
+		result := "added"
+		if e.DryRun {
+			result = "would_add"
+		}
+		m := r.match(e.Track, result)
+		m.Spotify, m.Playlist = e.Spotify.String(), e.Playlist
+	case AlreadyAdded:
+		if r.run != nil {
+			r.run.Present++
+		}
+		m := r.match(e.Track, "already_added")
+		m.Spotify, m.Playlist = e.Spotify.String(), e.Playlist
+	case SearchMiss:
+		if r.run != nil {
+			r.run.Misses++
+		}
+		r.match(e.Track, "not_found")
+	case SearchFailed:
+		r.failed(event)
+		r.match(e.Track, "failed").Error = e.Err.Error()
+	case AddFailed:
+		r.failed(event)
+		m := r.match(e.Track, "failed")
+		m.Spotify, m.Playlist = e.Spotify.String(), e.Playlist
+		m.Error = e.Err.Error()
+	case PlaylistFailed:
+		r.failed(event)
+	case ScheduleFailed, NowPlayingFailed, HistoryFailed, EvictFailed,
+		TokenRefreshFailed:
+		r.countError(event)
+	}
+}
+
+// Status returns the current state of the sync.
+func (sync *Sync) Status() Status {
+	sync.events()
+	recorder := sync.recorder
+	recorder.mu.Lock()
+	status := Status{
+		Now:      recorder.now,
+		LastRun:  recorder.lastRun,
+		NextSync: recorder.nextSync,
+		Recent:   append([]MatchStatus{}, recorder.recent...),
+		Errors:   make(map[string]map[string]int),
+	}
+	for radio, counts := range recorder.errors {
+		status.Errors[radio] = make(map[string]int)
+		for name, n := range counts {
+			status.Errors[radio][name] = n
+		}
+	}
+	recorder.mu.Unlock()
+
+	status.Cache.Tracks = []CachedTrack{}
+	if cache := sync.currentCache(); cache != nil {
+		status.Cache.Size = cache.Len()
+		status.Cache.Max = cache.Max()
+		for _, t := range cache.Tracks() {
+			status.Cache.Tracks = append(status.Cache.Tracks,
+				CachedTrack{ID: t.Id, Name: t.Name, URI: t.Uri})
+		}
+	}
+	status.Playlist.Name = sync.Playlist.String()
+	if linked, ok := sync.Playlist.(linkedPlaylist); ok {
+		status.Playlist.ID = linked.ID()
+		status.Playlist.URL = linked.URL()
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// readOnly returns a handler which only allows GET and HEAD requests.
+func readOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Handler returns a handler serving the status of the sync as JSON.
+//
+// The complete status is served at /status, and its parts at /status/now,
+// /status/run, /status/recent, /status/cache, /status/errors and
+// /status/playlist. Liveness and readiness are served at /healthz and
+// /readyz, with status 503 if any check fails. Metrics are served at
+// /metrics, if enabled.
+func (sync *Sync) Handler() http.Handler {
+	sync.events()
+	parts := map[string]func(Status) interface{}{
+		"/status": func(s Status) interface{} { return s },
+		"/status/now": func(s Status) interface{} {
+			return s.Now
+		},
+		"/status/run": func(s Status) interface{} {
+			return map[string]interface{}{
+				"last_run":  s.LastRun,
+				"next_sync": s.NextSync,
+			}
+		},
+		"/status/recent": func(s Status) interface{} {
+			return s.Recent
+		},
+		"/status/cache": func(s Status) interface{} { return s.Cache },
+		"/status/errors": func(s Status) interface{} {
+			return s.Errors
+		},
+		"/status/playlist": func(s Status) interface{} {
+			return s.Playlist
+		},
+	}
+	mux := http.NewServeMux()
+	for path, part := range parts {
+		part := part
+		mux.HandleFunc(path, readOnly(func(w http.ResponseWriter,
+			r *http.Request) {
+			writeJSON(w, http.StatusOK, part(sync.Status()))
+		}))
+	}
+	mux.HandleFunc("/healthz", readOnly(sync.serveHealth(sync.Live)))
+	mux.HandleFunc("/readyz", readOnly(sync.serveHealth(sync.Ready)))
+	if sync.Metrics != nil {
+		mux.Handle("/metrics", sync.Metrics)
+	}
+	return mux
+}
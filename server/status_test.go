@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/spotify/spotifytest"
+)
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200 from %s, got %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sync, _, sink := newTestSync(t,
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	server := httptest.NewServer(sync.Handler())
+	defer server.Close()
+
+	var status Status
+	getJSON(t, server.URL+"/status", &status)
+	if status.Now != nil || status.LastRun != nil ||
+		status.NextSync != nil {
+		t.Fatalf("Expected empty status before first run, got %+v",
+			status)
+	}
+
+	<-sync.runForever()
+	getJSON(t, server.URL+"/status", &status)
+	now := status.Now
+	if now == nil || now.Radio != "NRK P3" ||
+		now.Current.Title != "Like a Rolling Stone" ||
+		*now.Current.Position != 60 || now.Current.Duration != 240 ||
+		now.Next.Title != "The Weight" {
+		t.Fatalf("Unexpected now playing: %+v", now)
+	}
+	run := status.LastRun
+	if run == nil || run.Added != 1 || run.Misses != 1 ||
+		run.Finished == nil || run.Error != "" {
+		t.Fatalf("Unexpected last run: %+v", run)
+	}
+	if expected := testStart.Add(6 * time.Minute); status.NextSync == nil ||
+		!status.NextSync.Equal(expected) {
+		t.Fatalf("Expected next sync at %s, got %v", expected,
+			status.NextSync)
+	}
+	if status.Cache.Size != 1 || status.Cache.Max != 10 ||
+		len(status.Cache.Tracks) != 1 ||
+		status.Cache.Tracks[0].Name != "Like a Rolling Stone" {
+		t.Fatalf("Unexpected cache: %+v", status.Cache)
+	}
+	if status.Playlist.Name != "NRK P3" || status.Playlist.URL != "" {
+		t.Fatalf("Unexpected playlist: %+v", status.Playlist)
+	}
+
+	sink.addErr = fmt.Errorf("gopher says no")
+	// A new cache makes the sync add the track again
+	sync.cache = newTrackCache(sync.CacheSize, nil)
+	<-sync.runForever()
+	var errors map[string]map[string]int
+	getJSON(t, server.URL+"/status/errors", &errors)
+	if errors["NRK P3"]["add_failed"] != 1 {
+		t.Fatalf("Expected 1 add failure, got %v", errors)
+	}
+	var recent []MatchStatus
+	getJSON(t, server.URL+"/status/recent", &recent)
+	var results []string
+	for _, m := range recent {
+		results = append(results, m.Track+": "+m.Result)
+	}
+	expected := []string{
+		"The Band - The Weight: not_found",
+		"Bob Dylan - Like a Rolling Stone: failed",
+		"The Band - The Weight: not_found",
+		"Bob Dylan - Like a Rolling Stone: added",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected recent results %q, got %q", expected,
+			results)
+	}
+	if recent[1].Error != "gopher says no" ||
+		!recent[1].Time.Equal(testStart.Add(6*time.Minute)) {
+		t.Fatalf("Unexpected failed match: %+v", recent[1])
+	}
+	var current NowStatus
+	getJSON(t, server.URL+"/status/now", &current)
+	if current.Current.Title != "Like a Rolling Stone" {
+		t.Fatalf("Unexpected now playing: %+v", current)
+	}
+	for _, path := range []string{"/status/run", "/status/cache",
+		"/status/playlist"} {
+		var v interface{}
+		getJSON(t, server.URL+path, &v)
+	}
+
+	resp, err := http.Post(server.URL+"/status", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestStatusDuringInit(t *testing.T) {
+	api := spotifytest.NewServer()
+	defer api.Close()
+	api.Latency = time.Millisecond
+	sync := &Sync{
+		Radio:     &testRadio{},
+		Playlist:  api.Sink("NRK P3"),
+		CacheSize: 10,
+		Events:    NewBus(),
+	}
+	handler := sync.Handler()
+	initialized := make(chan struct{})
+	done := make(chan struct{})
+	// Status is served while the sync is initialized
+	go func() {
+		defer close(done)
+		for {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET",
+				"/status", nil))
+			if w.Code != 200 {
+				t.Errorf("Expected 200, got %d", w.Code)
+			}
+			select {
+			case <-initialized:
+				return
+			default:
+			}
+		}
+	}()
+	err := sync.Init()
+	close(initialized)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
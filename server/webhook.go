@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/logger"
+	"github.com/mreiferson/go-httpclient"
+)
+
+const (
+	// defaultTemplate is understood by Slack, Mattermost and Matrix hooks
+	defaultTemplate = `{"text": {{json .Text}}}`
+	// defaultRunFailures is the default number of consecutive failed
+	// runs before run_failed is notified
+	defaultRunFailures = 3
+	// webhookQueue is the number of notifications waiting for delivery
+	// before new ones are dead-lettered
+	webhookQueue = 100
+)
+
+// webhookClient is used if a Notifier has no client. Its timeouts keep a
+// hanging webhook from holding up the deliveries queued after it.
+var webhookClient = &http.Client{Transport: &httpclient.Transport{
+	ConnectTimeout:        2 * time.Second,
+	RequestTimeout:        10 * time.Second,
+	ResponseHeaderTimeout: 5 * time.Second,
+}}
+
+// Webhook is an HTTP endpoint which receives a JSON POST request for each of
+// its events.
+type Webhook struct {
+	URL string `json:"url"`
+	// Events are the names of the events to notify, such as track_added,
+	// search_miss, run_failed and token_refresh_failed
+	Events []string `json:"events"`
+	// Template is a text/template of the request body, executed with a
+	// Notification. Defaults to defaultTemplate
+	Template string            `json:"template"`
+	Headers  map[string]string `json:"headers"`
+	// RunFailures is the number of consecutive failed runs before
+	// run_failed is notified. Defaults to 3
+	RunFailures int `json:"run_failures"`
+
+	template *template.Template
+}
+
+// Notification is the data of a webhook template.
+type Notification struct {
+	Event     string    `json:"event"`
+	Channel   string    `json:"channel"`
+	Time      time.Time `json:"time"`
+	Text      string    `json:"text"`
+	Track     string    `json:"track,omitempty"`
+	Programme string    `json:"programme,omitempty"`
+	Spotify   string    `json:"spotify,omitempty"`
+	SpotifyID string    `json:"spotify_id,omitempty"`
+	Playlist  string    `json:"playlist,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Failures is the number of consecutive failed runs
+	Failures int `json:"failures,omitempty"`
+	// DryRun is true if the track was not actually added
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// DeadLetter is a notification which could not be delivered.
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Event    string    `json:"event"`
+	Body     string    `json:"body"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+}
+
+type delivery struct {
+	webhook *Webhook
+	event   string
+	body    []byte
+}
+
+// Notifier delivers events to webhooks. Deliveries are retried with backoff
+// for up to MaxElapsed, and appended to the DeadLetters file if they fail.
+type Notifier struct {
+	Webhooks    []Webhook `json:"webhooks"`
+	DeadLetters string    `json:"dead_letters"`
+	// Channel identifies the synced channel in notifications
+	Channel string       `json:"-"`
+	Client  *http.Client `json:"-"`
+	Clock   clock.Clock  `json:"-"`
+	// MaxElapsed defaults to 5 minutes
+	MaxElapsed time.Duration `json:"-"`
+	// Logger defaults to Log
+	Logger *logger.Logger `json:"-"`
+
+	mu        sync.Mutex
+	once      sync.Once
+	queue     chan delivery
+	pending   sync.WaitGroup
+	runFailed bool
+	failures  int
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ReadWebhooks reads a notifier from the JSON file name.
+func ReadWebhooks(name string) (*Notifier, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var n Notifier
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	for i := range n.Webhooks {
+		if err := n.Webhooks[i].parse(); err != nil {
+			return nil, fmt.Errorf("%s: webhook %d: %s", name, i+1,
+				err)
+		}
+	}
+	return &n, nil
+}
+
+func (w *Webhook) parse() error {
+	if w.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("events are required")
+	}
+	text := w.Template
+	if text == "" {
+		text = defaultTemplate
+	}
+	t, err := template.New(w.URL).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+	w.template = t
+	return nil
+}
+
+func (w *Webhook) wants(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) runFailures() int {
+	if w.RunFailures <= 0 {
+		return defaultRunFailures
+	}
+	return w.RunFailures
+}
+
+// notification returns the notification of event, or nil if the event is not
+// notifiable.
+func (n *Notifier) notification(event Event) *Notification {
+	msg := &Notification{
+		Event:   event.Name(),
+		Channel: n.Channel,
+		Time:    clock.OrReal(n.Clock).Now(),
+	}
+	switch e := event.(type) {
+	case TrackAdded:
+		msg.Track, msg.Programme = e.Track.String(), e.Track.Programme
+		msg.Spotify, msg.SpotifyID = e.Spotify.String(), e.Spotify.Id
+		msg.Playlist, msg.DryRun = e.Playlist, e.DryRun
+		verb := "Added"
+		if e.DryRun {
+			verb = "Would add"
+		}
+		msg.Text = fmt.Sprintf("%s %s to %s", verb, msg.Spotify,
+			msg.Playlist)
+	case SearchMiss:
+		msg.Track, msg.Programme = e.Track.String(), e.Track.Programme
+		msg.Text = fmt.Sprintf("Track not found: %s", msg.Track)
+	case RunFailed:
+		msg.Error = e.Err.Error()
+		msg.Failures = n.failures
+		msg.Text = fmt.Sprintf("Sync failed %d times in a row: %s",
+			n.failures, msg.Error)
+	case TokenRefreshFailed:
+		msg.Error = e.Err.Error()
+		msg.Text = fmt.Sprintf("Spotify token refresh failed: %s",
+			msg.Error)
+	default:
+		return nil
+	}
+	return msg
+}
+
+// notify renders event for the webhooks which want it, and queues the
+// deliveries.
+func (n *Notifier) notify(event Event) {
+	n.mu.Lock()
+	switch event.(type) {
+	case RunStarted:
+		n.runFailed = false
+	case RunFailed:
+		n.runFailed = true
+		n.failures++
+	case RunFinished:
+		if !n.runFailed {
+			n.failures = 0
+		}
+	}
+	failures := n.failures
+	msg := n.notification(event)
+	n.mu.Unlock()
+	if msg == nil {
+		return
+	}
+	for i := range n.Webhooks {
+		w := &n.Webhooks[i]
+		if !w.wants(msg.Event) {
+			continue
+		}
+		if msg.Event == "run_failed" && failures != w.runFailures() {
+			continue
+		}
+		var body bytes.Buffer
+		if err := w.template.Execute(&body, msg); err != nil {
+			n.deadLetter(w, msg.Event, body.Bytes(), err, 0)
+			continue
+		}
+		n.enqueue(delivery{webhook: w, event: msg.Event,
+			body: body.Bytes()})
+	}
+}
+
+func (n *Notifier) enqueue(d delivery) {
+	n.once.Do(func() {
+		n.queue = make(chan delivery, webhookQueue)
+		go n.deliverAll()
+	})
+	n.pending.Add(1)
+	select {
+	case n.queue <- d:
+	default:
+		n.deadLetter(d.webhook, d.event, d.body,
+			fmt.Errorf("delivery queue is full"), 0)
+		n.pending.Done()
+	}
+}
+
+func (n *Notifier) deliverAll() {
+	for d := range n.queue {
+		attempts, err := n.deliver(d)
+		if err != nil {
+			n.deadLetter(d.webhook, d.event, d.body, err, attempts)
+		}
+		n.pending.Done()
+	}
+}
+
+// Wait blocks until all queued notifications are delivered or dead-lettered.
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
+
+func (n *Notifier) post(w *Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	client := n.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded with %s", resp.Status)
+	// Client errors will not go away by retrying, except rate limiting
+	if resp.StatusCode/100 == 4 &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
+// deliver posts d until it succeeds or fails permanently, and returns the
+// number of attempts.
+func (n *Notifier) deliver(d delivery) (int, error) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = n.MaxElapsed
+	if b.MaxElapsedTime == 0 {
+		b.MaxElapsedTime = 5 * time.Minute
+	}
+	b.Clock = clock.OrReal(n.Clock)
+	b.Reset()
+	for attempt := 1; ; attempt++ {
+		err := n.post(d.webhook, d.body)
+		if err == nil {
+			return attempt, nil
+		}
+		if permanent, ok := err.(*backoff.PermanentError); ok {
+			return attempt, permanent.Err
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return attempt, err
+		}
+		<-clock.OrReal(n.Clock).After(next)
+	}
+}
+
+func (n *Notifier) log() *logger.Logger {
+	if n.Logger == nil {
+		return Log
+	}
+	return n.Logger
+}
+
+// deadLetter records a notification which could not be delivered.
+func (n *Notifier) deadLetter(w *Webhook, event string, body []byte,
+	err error, attempts int) {
+	n.log().Error("Failed to deliver notification",
+		logger.F("url", w.URL), logger.F("event", event),
+		logger.F("attempts", attempts), logger.F("error", err))
+	if n.DeadLetters == "" {
+		return
+	}
+	letter := DeadLetter{
+		Time:     clock.OrReal(n.Clock).Now(),
+		URL:      w.URL,
+		Event:    event,
+		Body:     string(body),
+		Error:    err.Error(),
+		Attempts: attempts,
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.DeadLetters,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(letter)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		n.log().Error("Failed to write dead letter",
+			logger.F("file", n.DeadLetters), logger.F("error", err))
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+)
+
+// webhookServer is a stand-in for a chat service receiving webhooks.
+type webhookServer struct {
+	*httptest.Server
+	mu       gosync.Mutex
+	bodies   []string
+	headers  []http.Header
+	statuses []int
+}
+
+func newWebhookServer() *webhookServer {
+	s := &webhookServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *webhookServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	s.headers = append(s.headers, r.Header)
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// respond makes the server respond with statuses, before responding OK.
+func (s *webhookServer) respond(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = statuses
+}
+
+func (s *webhookServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func newTestNotifier(t *testing.T, webhooks ...Webhook) *Notifier {
+	for i := range webhooks {
+		if err := webhooks[i].parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Notifier{
+		Webhooks: webhooks,
+		Channel:  "p3",
+		Clock:    clock.NewFake(testStart),
+	}
+}
+
+func readDeadLetters(t *testing.T, name string) []DeadLetter {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestReadWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "webhooks.json")
+	write := func(data string) {
+		err := ioutil.WriteFile(name, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{
+  "dead_letters": "dead.json",
+  "webhooks": [
+    {"url": "http://chat/hook", "events": ["track_added"]},
+    {"url": "http://chat/other", "events": ["run_failed"],
+     "template": "{\"msg\": {{json .Error}}}", "run_failures": 5}
+  ]
+}`)
+	n, err := ReadWebhooks(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.DeadLetters != "dead.json" || len(n.Webhooks) != 2 ||
+		n.Webhooks[0].runFailures() != 3 ||
+		n.Webhooks[1].runFailures() != 5 {
+		t.Fatalf("Unexpected notifier: %+v", n)
+	}
+
+	for _, data := range []string{
+		`{"webhooks": [{"events": ["track_added"]}]}`,
+		`{"webhooks": [{"url": "http://chat/hook"}]}`,
+		`{"webhooks": [{"url": "http://chat/hook",
+		  "events": ["track_added"], "template": "{{.Text"}]}`,
+		`{"webhooks": {}}`,
+	} {
+		write(data)
+		if _, err := ReadWebhooks(name); err == nil {
+			t.Fatalf("Expected error for %s", data)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	chat := newWebhookServer()
+	defer chat.Close()
+	sync, _, sink := newUninitializedSync(
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	sink.add("Bob Dylan", "Like a Rolling Stone")
+	sync.Notifier = newTestNotifier(t,
+		Webhook{
+			URL:    chat.URL + "/added",
+			Events: []string{"track_added"},
+		},
+		Webhook{
+			URL:    chat.URL + "/missing",
+			Events: []string{"search_miss"},
+			Template: `{"channel": {{json .Channel}}, ` +
+				`"track": {{json .Track}}}`,
+			Headers: map[string]string{
+				"Authorization": "Bearer t",
+			},
+		})
+	initTestSync(t, sync)
+	<-sync.runForever()
+	sync.Notifier.Wait()
+
+	added := "Like a Rolling Stone (Like a Rolling Stone)"
+	expected := []string{
+		`{"text": "Added ` + added + ` to NRK P3"}`,
+		`{"channel": "p3", "track": "The Band - The Weight"}`,
+	}
+	if got := chat.received(); strings.Join(got, "\n") !=
+		strings.Join(expected, "\n") {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	if h := chat.headers[1]; h.Get("Authorization") != "Bearer t" ||
+		h.Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected headers: %v", h)
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	chat := newWebhookServer()
+	defer chat.Close()
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := newTestNotifier(t, Webhook{
+		URL:    chat.URL,
+		Events: []string{"token_refresh_failed"},
+	})
+	n.DeadLetters = filepath.Join(dir, "dead.json")
+	n.MaxElapsed = time.Minute
+	event := TokenRefreshFailed{Err: fmt.Errorf("invalid_grant")}
+
+	// Server errors are retried
+	chat.respond(500, 502)
+	n.notify(event)
+	n.Wait()
+	if got := len(chat.received()); got != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", got)
+	}
+	if letters := readDeadLetters(t, n.DeadLetters); len(letters) != 0 {
+		t.Fatalf("Expected no dead letters, got %+v", letters)
+	}
+
+	// Client errors are not
+	chat.respond(400)
+	n.notify(event)
+	n.Wait()
+	if got := len(chat.received()); got != 4 {
+		t.Fatalf("Expected 4 attempts, got %d", got)
+	}
+
+	// Neither are server errors after MaxElapsed
+	statuses := make([]int, 100)
+	for i := range statuses {
+		statuses[i] = 503
+	}
+	chat.respond(statuses...)
+	n.notify(event)
+	n.Wait()
+
+	letters := readDeadLetters(t, n.DeadLetters)
+	if len(letters) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %+v", letters)
+	}
+	body := `{"text": "Spotify token refresh failed: invalid_grant"}`
+	if l := letters[0]; l.Attempts != 1 || l.URL != chat.URL ||
+		l.Event != "token_refresh_failed" || l.Body != body ||
+		l.Error != "webhook responded with 400 Bad Request" {
+		t.Fatalf("Unexpected dead letter: %+v", l)
+	}
+	if l := letters[1]; l.Attempts < 2 ||
+		l.Error != "webhook responded with 503 Service Unavailable" {
+		t.Fatalf("Unexpected dead letter: %+v", l)
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer hanging.Close()
+	defer close(release)
+	defer func(c *http.Client) { webhookClient = c }(webhookClient)
+	webhookClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := newTestNotifier(t, Webhook{
+		URL:    hanging.URL,
+		Events: []string{"token_refresh_failed"},
+	})
+	n.DeadLetters = filepath.Join(dir, "dead.json")
+	n.MaxElapsed = time.Second
+	n.notify(TokenRefreshFailed{Err: fmt.Errorf("invalid_grant")})
+
+	done := make(chan struct{})
+	go func() {
+		n.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected delivery to a hanging webhook to time out")
+	}
+	if letters := readDeadLetters(t, n.DeadLetters); len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %+v", letters)
+	}
+}
+
+func TestNotifyRunFailures(t *testing.T) {
+	chat := newWebhookServer()
+	defer chat.Close()
+	sync, radio, sink := newUninitializedSync(
+		testTrack("Bob Dylan", "Hurricane", "Music", -4*time.Minute),
+		testTrack("Bob Dylan", "Like a Rolling Stone", "Music", 0),
+		testTrack("The Band", "The Weight", "Music", 4*time.Minute))
+	// Keep the radio playing the same track while runs advance the clock
+	radio.playlist.Clock = clock.NewFake(testStart.Add(time.Minute))
+	refreshing := &refreshingSink{testSink: sink}
+	sync.Playlist = refreshing
+	sync.Notifier = newTestNotifier(t, Webhook{
+		URL:         chat.URL,
+		Events:      []string{"run_failed", "token_refresh_failed"},
+		Template:    `{{.Event}} {{.Failures}} {{.Error}}`,
+		RunFailures: 2,
+	})
+	initTestSync(t, sync)
+
+	run := func(times int) {
+		for i := 0; i < times; i++ {
+			<-sync.runForever()
+		}
+		sync.Notifier.Wait()
+	}
+	radio.err = fmt.Errorf("gopher says no")
+	run(3)
+	radio.err = nil
+	run(1)
+	radio.err = fmt.Errorf("gopher says no again")
+	run(2)
+	radio.err = nil
+
+	// Token refresh failures are notified when they start
+	refreshing.refreshErr = fmt.Errorf("invalid_grant")
+	run(2)
+	refreshing.refreshErr = nil
+	run(1)
+	refreshing.refreshErr = fmt.Errorf("invalid_grant")
+	run(1)
+
+	expected := []string{
+		"run_failed 2 gopher says no",
+		"run_failed 2 gopher says no again",
+		"token_refresh_failed 0 invalid_grant",
+		"token_refresh_failed 0 invalid_grant",
+	}
+	if got := chat.received(); strings.Join(got, "\n") !=
+		strings.Join(expected, "\n") {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
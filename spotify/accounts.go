@@ -0,0 +1,127 @@
+package spotify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var accountPattern = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+type Accounts struct {
+	Dir string
+}
+
+type Account struct {
+	Name      string `json:"name"`
+	ProfileId string `json:"profile_id"`
+	TokenFile string `json:"token_file"`
+}
+
+func (accounts *Accounts) TokenFile(name string) (string, error) {
+	if !accountPattern.MatchString(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid account name: %q", name)
+	}
+	return filepath.Join(accounts.Dir, name+".json"), nil
+}
+
+func (accounts *Accounts) Create(name string) (string, error) {
+	tokenFile, err := accounts.TokenFile(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(accounts.Dir, 0700); err != nil {
+		return "", err
+	}
+	return tokenFile, nil
+}
+
+func (accounts *Accounts) Open(name string) (*Spotify, error) {
+	spotify, err := accounts.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := spotify.Init(); err != nil {
+		return nil, err
+	}
+	return spotify, nil
+}
+
+// Load reads the token file of the account name, without making requests.
+func (accounts *Accounts) Load(name string) (*Spotify, error) {
+	tokenFile, err := accounts.TokenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(tokenFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("account not found: %s", name)
+	}
+	return Load(tokenFile)
+}
+
+func (accounts *Accounts) List() ([]Account, error) {
+	files, err := ioutil.ReadDir(accounts.Dir)
+	if os.IsNotExist(err) {
+		return []Account{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Account, 0, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || name == f.Name() {
+			continue
+		}
+		tokenFile := filepath.Join(accounts.Dir, f.Name())
+		spotify, err := Load(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", tokenFile, err)
+		}
+		list = append(list, Account{
+			Name:      name,
+			ProfileId: spotify.Profile.Id,
+			TokenFile: tokenFile,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (accounts *Accounts) Remove(name string) error {
+	tokenFile, err := accounts.TokenFile(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(tokenFile); os.IsNotExist(err) {
+		return fmt.Errorf("account not found: %s", name)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Load reads the token file at filepath. Unlike New, it makes no requests and
+// does not change the file.
+func Load(filepath string) (*Spotify, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var spotify Spotify
+	if err := json.Unmarshal(data, &spotify); err != nil {
+		return nil, err
+	}
+	// Fix path to token file, in case it has moved. The file is fixed by
+	// Init
+	spotify.moved = spotify.Auth.TokenFile != filepath
+	spotify.Auth.TokenFile = filepath
+	return &spotify, nil
+}
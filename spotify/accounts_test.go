@@ -0,0 +1,91 @@
+package spotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAccounts(t *testing.T) (*Accounts, func()) {
+	dir, err := ioutil.TempDir("", "spotify_accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := &Accounts{Dir: filepath.Join(dir, "accounts")}
+	return accounts, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAccountsTokenFile(t *testing.T) {
+	accounts := Accounts{Dir: "/tmp/accounts"}
+	tokenFile, err := accounts.TokenFile("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "/tmp/accounts/team.json"; tokenFile != expected {
+		t.Fatalf("Expected %s, got %s", expected, tokenFile)
+	}
+	for _, name := range []string{"", "..", ".hidden", "../team", "a/b"} {
+		if _, err := accounts.TokenFile(name); err == nil {
+			t.Fatalf("Expected error for account name %q", name)
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	accounts, cleanup := newTestAccounts(t)
+	defer cleanup()
+
+	list, err := accounts.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("Expected 0 accounts, got %d", len(list))
+	}
+
+	for _, name := range []string{"personal", "team"} {
+		tokenFile, err := accounts.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spotify := Spotify{Profile: Profile{Id: name + "-id"}}
+		if err := spotify.Save(tokenFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err = accounts.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 accounts, got %d", len(list))
+	}
+	if list[0].Name != "personal" || list[0].ProfileId != "personal-id" {
+		t.Fatalf("Unexpected account: %+v", list[0])
+	}
+	if list[1].Name != "team" || list[1].ProfileId != "team-id" {
+		t.Fatalf("Unexpected account: %+v", list[1])
+	}
+
+	if err := accounts.Remove("team"); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Remove("team"); err == nil {
+		t.Fatal("Expected error when removing missing account")
+	}
+	if _, err := accounts.Open("team"); err == nil {
+		t.Fatal("Expected error when opening missing account")
+	}
+	list, err = accounts.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 account, got %d", len(list))
+	}
+}
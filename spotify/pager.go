@@ -0,0 +1,163 @@
+package spotify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// maxSearchLimit is the maximum number of search results per page.
+const maxSearchLimit = 50
+
+// page is a page of a paging object.
+type page interface {
+	// next returns the URL of the next page, or an empty string if this
+	// is the last page
+	next() string
+}
+
+func (playlists *Playlists) next() string { return playlists.Next }
+
+func (tracks *PlaylistTracks) next() string { return tracks.Next }
+
+func (result *SearchResult) next() string { return result.Tracks.Next }
+
+// pager reads the pages of a paging object. It is embedded in the pager of
+// each kind of page, which returns the page read with its own type.
+type pager struct {
+	spotify *Spotify
+	url     string
+	err     error
+}
+
+// read reads the next page into page. It returns false when there are no
+// more pages, or reading a page failed.
+func (pager *pager) read(page page) bool {
+	if pager.err != nil || pager.url == "" {
+		return false
+	}
+	body, err := pager.spotify.get(pager.url)
+	if err != nil {
+		pager.err = err
+		return false
+	}
+	if err := json.Unmarshal(body, page); err != nil {
+		pager.err = err
+		return false
+	}
+	pager.url = page.next()
+	return true
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (pager *pager) Err() error {
+	return pager.err
+}
+
+// PlaylistPager iterates over the playlists of the current user:
+//
+//	pager := spotify.PlaylistPager()
+//	for pager.Next() {
+//		playlists := pager.Page()
+//		...
+//	}
+//	if err := pager.Err(); err != nil {
+//		...
+//	}
+type PlaylistPager struct {
+	pager
+	page *Playlists
+}
+
+// PlaylistPager returns a pager of the playlists of the current user.
+func (spotify *Spotify) PlaylistPager() *PlaylistPager {
+	url := fmt.Sprintf("%s/users/%s/playlists", spotify.apiURL(),
+		spotify.Profile.Id)
+	return &PlaylistPager{pager: pager{spotify: spotify, url: url}}
+}
+
+// Next reads the next page. It returns false when there are no more pages,
+// or reading a page failed.
+func (pager *PlaylistPager) Next() bool {
+	page := &Playlists{}
+	if !pager.read(page) {
+		return false
+	}
+	pager.page = page
+	return true
+}
+
+// Page returns the page read by the last call to Next.
+func (pager *PlaylistPager) Page() *Playlists {
+	return pager.page
+}
+
+// PlaylistTrackPager iterates over the tracks of a playlist, like
+// PlaylistPager.
+type PlaylistTrackPager struct {
+	pager
+	page *PlaylistTracks
+}
+
+// PlaylistTrackPager returns a pager of the tracks of playlist, starting at
+// offset.
+func (spotify *Spotify) PlaylistTrackPager(playlist *Playlist,
+	offset int) *PlaylistTrackPager {
+	params := url.Values{"offset": {strconv.Itoa(offset)}}
+	url := fmt.Sprintf("%s/users/%s/playlists/%s/tracks?%s",
+		spotify.apiURL(), spotify.Profile.Id, playlist.Id,
+		params.Encode())
+	return &PlaylistTrackPager{pager: pager{spotify: spotify, url: url}}
+}
+
+// Next reads the next page. It returns false when there are no more pages,
+// or reading a page failed.
+func (pager *PlaylistTrackPager) Next() bool {
+	page := &PlaylistTracks{}
+	if !pager.read(page) {
+		return false
+	}
+	pager.page = page
+	return true
+}
+
+// Page returns the page read by the last call to Next.
+func (pager *PlaylistTrackPager) Page() *PlaylistTracks {
+	return pager.page
+}
+
+// SearchPager iterates over the results of a search, like PlaylistPager.
+type SearchPager struct {
+	pager
+	page *SearchResult
+}
+
+// SearchPager returns a pager of the results of searching for query, with
+// limit results per page.
+func (spotify *Spotify) SearchPager(query string, types string,
+	limit int) *SearchPager {
+	params := url.Values{
+		"q":     {query},
+		"type":  {types},
+		"limit": {strconv.Itoa(limit)},
+	}
+	url := spotify.apiURL() + "/search?" + params.Encode()
+	return &SearchPager{pager: pager{spotify: spotify, url: url}}
+}
+
+// Next reads the next page. It returns false when there are no more pages,
+// or reading a page failed.
+func (pager *SearchPager) Next() bool {
+	page := &SearchResult{}
+	if !pager.read(page) {
+		return false
+	}
+	pager.page = page
+	return true
+}
+
+// Page returns the page read by the last call to Next.
+func (pager *SearchPager) Page() *SearchResult {
+	return pager.page
+}
@@ -0,0 +1,188 @@
+package spotify
+
+import "sync"
+
+// Sink is a playlist owned by the current user, which is created on Open if
+// it does not exist. A sink which is not opened reads as empty.
+type Sink struct {
+	Spotify  *Spotify
+	Name     string
+	playlist *Playlist
+	// mu guards playlist, which is read by String, ID and URL while the
+	// sink is opened
+	mu sync.Mutex
+	// index counts the occurrences of each track in the playlist, as of the
+	// snapshot indexed
+	index   map[string]int
+	indexed string
+}
+
+func NewSink(spotify *Spotify, name string) *Sink {
+	return &Sink{Spotify: spotify, Name: name}
+}
+
+func (sink *Sink) Open() error {
+	playlist, err := sink.Spotify.GetOrCreatePlaylist(sink.Name)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	sink.playlist = playlist
+	sink.mu.Unlock()
+	return nil
+}
+
+// OpenExisting opens the playlist only if it exists, and returns whether it
+// does.
+func (sink *Sink) OpenExisting() (bool, error) {
+	playlist, err := sink.Spotify.Playlist(sink.Name)
+	if err != nil || playlist == nil {
+		return false, err
+	}
+	sink.mu.Lock()
+	sink.playlist = playlist
+	sink.mu.Unlock()
+	return true, nil
+}
+
+// opened returns the playlist of the sink, or nil if it has not been
+// opened.
+func (sink *Sink) opened() *Playlist {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.playlist
+}
+
+func (sink *Sink) Tracks() ([]Track, error) {
+	if sink.playlist == nil {
+		return nil, nil
+	}
+	items, err := sink.Spotify.PlaylistTracks(sink.playlist)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]Track, len(items))
+	for i, item := range items {
+		tracks[i] = item.Track
+	}
+	return tracks, nil
+}
+
+func (sink *Sink) Search(artist string, track string) ([]Track, error) {
+	return sink.Spotify.SearchArtistTrack(artist, track)
+}
+
+func (sink *Sink) reindex(snapshot string) error {
+	items, err := sink.Spotify.PlaylistTracks(sink.playlist)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(items))
+	for _, item := range items {
+		index[item.Track.Id]++
+	}
+	sink.index = index
+	sink.indexed = snapshot
+	sink.playlist.SnapshotId = snapshot
+	return nil
+}
+
+// Contains returns true if track is in the playlist. All tracks of the
+// playlist are indexed, and indexed again only when the snapshot of the
+// playlist shows that someone else has changed it.
+func (sink *Sink) Contains(track *Track) (bool, error) {
+	if sink.playlist == nil {
+		return false, nil
+	}
+	snapshot, err := sink.Spotify.PlaylistSnapshot(sink.playlist)
+	if err != nil {
+		return false, err
+	}
+	if sink.index == nil || snapshot != sink.indexed {
+		if err := sink.reindex(snapshot); err != nil {
+			return false, err
+		}
+	}
+	return sink.index[track.Id] > 0, nil
+}
+
+// change applies a change of the playlist to the index, if the index was up
+// to date before the change.
+func (sink *Sink) change(before string, fn func(index map[string]int)) {
+	if sink.index == nil || before != sink.indexed {
+		return
+	}
+	fn(sink.index)
+	sink.indexed = sink.playlist.SnapshotId
+}
+
+func (sink *Sink) Add(track *Track) error {
+	before := sink.playlist.SnapshotId
+	if err := sink.Spotify.AddTrack(sink.playlist, track); err != nil {
+		return err
+	}
+	sink.change(before, func(index map[string]int) { index[track.Id]++ })
+	return nil
+}
+
+func (sink *Sink) Delete(track *Track) error {
+	before := sink.playlist.SnapshotId
+	if err := sink.Spotify.DeleteTrack(sink.playlist, track); err != nil {
+		return err
+	}
+	// Deleting a track deletes all of its occurrences
+	sink.change(before, func(index map[string]int) {
+		delete(index, track.Id)
+	})
+	return nil
+}
+
+// Replace replaces the tracks of the playlist with tracks, and reads the
+// playlist again.
+func (sink *Sink) Replace(tracks []Track) error {
+	err := sink.Spotify.ReplaceTracks(sink.playlist, tracks)
+	if err != nil {
+		return err
+	}
+	playlist, err := sink.Spotify.PlaylistById(sink.playlist.Id)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	sink.playlist = playlist
+	sink.mu.Unlock()
+	return nil
+}
+
+func (sink *Sink) String() string {
+	playlist := sink.opened()
+	if playlist == nil {
+		return sink.Name
+	}
+	return playlist.String()
+}
+
+// ID returns the Spotify ID of the playlist, or an empty string if it has not
+// been opened.
+func (sink *Sink) ID() string {
+	playlist := sink.opened()
+	if playlist == nil {
+		return ""
+	}
+	return playlist.Id
+}
+
+// URL returns the web URL of the playlist, or an empty string if it has not
+// been opened.
+func (sink *Sink) URL() string {
+	playlist := sink.opened()
+	if playlist == nil {
+		return ""
+	}
+	return "https://open.spotify.com/playlist/" + playlist.Id
+}
+
+// RefreshError returns the error of the last token refresh of the client.
+func (sink *Sink) RefreshError() error {
+	return sink.Spotify.RefreshError()
+}
@@ -7,31 +7,64 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strconv"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/mreiferson/go-httpclient"
 )
 
-var transport = &httpclient.Transport{
+// Transport is the transport of the default client, which is used if no
+// client is set.
+var Transport = &httpclient.Transport{
 	ConnectTimeout:        2 * time.Second,
 	RequestTimeout:        10 * time.Second,
 	ResponseHeaderTimeout: 5 * time.Second,
 }
 
-var client = &http.Client{Transport: transport}
+var client = &http.Client{Transport: Transport}
 
+const defaultAPIURL string = "https://api.spotify.com/v1"
+
+// Spotify is a client of the Spotify Web API. APIURL and AccountsURL override
+// the URLs of the Spotify services. They are runtime settings, and are not
+// saved with the token.
 type Spotify struct {
-	Token   `json:"token"`
-	Auth    `json:"auth"`
-	Profile `json:"profile"`
+	Token       `json:"token"`
+	Auth        `json:"auth"`
+	Profile     `json:"profile"`
+	APIURL      string       `json:"-"`
+	AccountsURL string       `json:"-"`
+	Client      *http.Client `json:"-"`
+
+	refreshMu  sync.Mutex
+	refreshErr error
+	// tokenMu guards the token, which is shared by concurrent requests
+	tokenMu sync.Mutex
+	// moved is true if the token file was loaded from another path than
+	// the one saved in it
+	moved bool
 }
 
 type Token struct {
-	AccessToken  string `json:"access_token"`
-	TokenType    string `json:"token_type"`
-	ExpiresIn    int    `json:"expires_in"`
-	RefreshToken string `json:"refresh_token"`
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int       `json:"expires_in"`
+	RefreshToken string    `json:"refresh_token"`
+	Scope        string    `json:"scope"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshedAt  time.Time `json:"refreshed_at"`
+}
+
+type TokenStatus struct {
+	ProfileId   string     `json:"profile_id"`
+	TokenFile   string     `json:"token_file"`
+	Scope       string     `json:"scope"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	Expired     bool       `json:"expired"`
+	Valid       bool       `json:"valid"`
+	Error       string     `json:"error,omitempty"`
 }
 
 type Profile struct {
@@ -46,6 +79,14 @@ type Playlist struct {
 	Id     string         `json:"id"`
 	Name   string         `json:"name"`
 	Tracks PlaylistTracks `json:"tracks"`
+	// SnapshotId identifies the version of the playlist. It changes
+	// whenever the tracks of the playlist change
+	SnapshotId string `json:"snapshot_id"`
+}
+
+// snapshot is the response to changing the tracks of a playlist.
+type snapshot struct {
+	SnapshotId string `json:"snapshot_id"`
 }
 
 type PlaylistTracks struct {
@@ -62,6 +103,8 @@ type PlaylistTrack struct {
 }
 
 type Playlists struct {
+	Next  string     `json:"next"`
+	Total int        `json:"total"`
 	Items []Playlist `json:"items"`
 }
 
@@ -75,6 +118,8 @@ type SearchResult struct {
 }
 
 type SearchTracks struct {
+	Next  string  `json:"next"`
+	Total int     `json:"total"`
 	Items []Track `json:"items"`
 }
 
@@ -84,6 +129,9 @@ type Track struct {
 	Uri  string `json:"uri"`
 }
 
+// Contains returns true if track is in the tracks loaded with playlist, which
+// are only the first page of its tracks. Use Sink.Contains to check all
+// tracks.
 func (playlist *Playlist) Contains(track Track) bool {
 	for _, item := range playlist.Tracks.Items {
 		if item.Track.Id == track.Id {
@@ -98,10 +146,47 @@ func (playlist *Playlist) String() string {
 		playlist.Tracks.Total)
 }
 
+func (spotify *Spotify) apiURL() string {
+	if spotify.APIURL == "" {
+		return defaultAPIURL
+	}
+	return spotify.APIURL
+}
+
+func (spotify *Spotify) accountsURL() string {
+	if spotify.AccountsURL == "" {
+		return spotify.Auth.URL()
+	}
+	return spotify.AccountsURL
+}
+
+func (spotify *Spotify) httpClient() *http.Client {
+	if spotify.Client == nil {
+		return client
+	}
+	return spotify.Client
+}
+
+func (token *Token) setExpiry(now time.Time) {
+	token.RefreshedAt = now
+	token.ExpiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+func (token *Token) Expired(now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt)
+}
+
 func (spotify *Spotify) update(token *Token) {
 	spotify.AccessToken = token.AccessToken
 	spotify.TokenType = token.TokenType
 	spotify.ExpiresIn = token.ExpiresIn
+	if token.Scope != "" {
+		spotify.Scope = token.Scope
+	}
+	if token.RefreshToken != "" {
+		spotify.RefreshToken = token.RefreshToken
+	}
+	spotify.Token.setExpiry(time.Now())
 }
 
 func (spotify *Spotify) updateToken() error {
@@ -109,13 +194,15 @@ func (spotify *Spotify) updateToken() error {
 		"grant_type":    {"refresh_token"},
 		"refresh_token": {spotify.RefreshToken},
 	}
-	url := "https://accounts.spotify.com/api/token"
-	client := &http.Client{}
+	url := spotify.accountsURL() + "/api/token"
 	req, err := http.NewRequest("POST", url,
 		bytes.NewBufferString(formData.Encode()))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Authorization", spotify.Auth.authHeader())
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
+	resp, err := spotify.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -124,6 +211,10 @@ func (spotify *Spotify) updateToken() error {
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("token refresh failed (%d): %s",
+			resp.StatusCode, body)
+	}
 
 	var newToken Token
 	if err := json.Unmarshal(body, &newToken); err != nil {
@@ -133,7 +224,108 @@ func (spotify *Spotify) updateToken() error {
 	return nil
 }
 
+func (spotify *Spotify) Refresh() error {
+	spotify.tokenMu.Lock()
+	err := spotify.refresh()
+	spotify.tokenMu.Unlock()
+	return spotify.recordRefresh(err)
+}
+
+// refreshStale refreshes the token, unless it has been refreshed since
+// authHeader was sent. Concurrent requests rejected with the same token
+// therefore only refresh it once.
+func (spotify *Spotify) refreshStale(authHeader string) error {
+	spotify.tokenMu.Lock()
+	if spotify.TokenType+" "+spotify.AccessToken != authHeader {
+		spotify.tokenMu.Unlock()
+		return nil
+	}
+	err := spotify.refresh()
+	spotify.tokenMu.Unlock()
+	return spotify.recordRefresh(err)
+}
+
+func (spotify *Spotify) recordRefresh(err error) error {
+	spotify.refreshMu.Lock()
+	spotify.refreshErr = err
+	spotify.refreshMu.Unlock()
+	return err
+}
+
+func (spotify *Spotify) refresh() error {
+	if err := spotify.updateToken(); err != nil {
+		return err
+	}
+	if spotify.Auth.TokenFile == "" {
+		return nil
+	}
+	return spotify.Save(spotify.Auth.TokenFile)
+}
+
+// RefreshError returns the error of the last token refresh, or nil if it
+// succeeded or no refresh has been made.
+func (spotify *Spotify) RefreshError() error {
+	spotify.refreshMu.Lock()
+	defer spotify.refreshMu.Unlock()
+	return spotify.refreshErr
+}
+
+func (spotify *Spotify) Revoke() error {
+	spotify.Token = Token{}
+	return os.Remove(spotify.Auth.TokenFile)
+}
+
+func (spotify *Spotify) TokenStatus() TokenStatus {
+	status := TokenStatus{
+		ProfileId: spotify.Profile.Id,
+		TokenFile: spotify.Auth.TokenFile,
+	}
+	status.Scope = spotify.Scope
+	status.Expired = spotify.Token.Expired(time.Now())
+	// An expired token is not sent to the API, as that would refresh it
+	if status.Expired {
+		status.Error = "access token has expired"
+	} else if err := spotify.checkToken(); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Valid = true
+	}
+	if t := spotify.ExpiresAt; !t.IsZero() {
+		status.ExpiresAt = &t
+	}
+	if t := spotify.RefreshedAt; !t.IsZero() {
+		status.RefreshedAt = &t
+	}
+	return status
+}
+
+// checkToken verifies the access token against the API. Unlike other
+// requests, a rejected token is not refreshed.
+func (spotify *Spotify) checkToken() error {
+	req, err := http.NewRequest("GET", spotify.apiURL()+"/me", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", spotify.authHeader())
+	resp, err := spotify.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("request failed (%d): %s", resp.StatusCode,
+			body)
+	}
+	return nil
+}
+
 func (spotify *Spotify) authHeader() string {
+	spotify.tokenMu.Lock()
+	defer spotify.tokenMu.Unlock()
 	return spotify.TokenType + " " + spotify.AccessToken
 }
 
@@ -146,10 +338,8 @@ func (spotify *Spotify) request(reqFn requestFn) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 401 || resp.StatusCode == 400 {
-		if err := spotify.updateToken(); err != nil {
-			return nil, err
-		}
-		if err := spotify.Save(spotify.Auth.TokenFile); err != nil {
+		sent := resp.Request.Header.Get("Authorization")
+		if err := spotify.refreshStale(sent); err != nil {
 			return nil, err
 		}
 		resp, err = reqFn()
@@ -176,7 +366,7 @@ func (spotify *Spotify) get(url string) ([]byte, error) {
 			return nil, err
 		}
 		req.Header.Set("Authorization", spotify.authHeader())
-		return client.Do(req)
+		return spotify.httpClient().Do(req)
 	}
 	return spotify.request(getFn)
 }
@@ -189,11 +379,24 @@ func (spotify *Spotify) post(url string, body []byte) ([]byte, error) {
 		}
 		req.Header.Set("Authorization", spotify.authHeader())
 		req.Header.Set("Content-Type", "application/json")
-		return client.Do(req)
+		return spotify.httpClient().Do(req)
 	}
 	return spotify.request(postFn)
 }
 
+func (spotify *Spotify) put(url string, body []byte) ([]byte, error) {
+	putFn := func() (*http.Response, error) {
+		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", spotify.authHeader())
+		req.Header.Set("Content-Type", "application/json")
+		return spotify.httpClient().Do(req)
+	}
+	return spotify.request(putFn)
+}
+
 func (spotify *Spotify) delete(url string, body []byte) ([]byte, error) {
 	deleteFn := func() (*http.Response, error) {
 		req, err := http.NewRequest("DELETE", url,
@@ -203,7 +406,7 @@ func (spotify *Spotify) delete(url string, body []byte) ([]byte, error) {
 		}
 		req.Header.Set("Authorization", spotify.authHeader())
 		req.Header.Set("Content-Type", "application/json")
-		return client.Do(req)
+		return spotify.httpClient().Do(req)
 	}
 	return spotify.request(deleteFn)
 }
@@ -220,32 +423,36 @@ func (spotify *Spotify) Save(filepath string) error {
 	return nil
 }
 
+// New reads the token file at filepath and initializes the client.
 func New(filepath string) (*Spotify, error) {
-	data, err := ioutil.ReadFile(filepath)
+	spotify, err := Load(filepath)
 	if err != nil {
 		return nil, err
 	}
-	var spotify Spotify
-	if err := json.Unmarshal(data, &spotify); err != nil {
+	if err := spotify.Init(); err != nil {
 		return nil, err
 	}
-	// Fix path to token file, in case it has moved
-	if spotify.Auth.TokenFile != filepath {
-		spotify.Auth.TokenFile = filepath
-		if err := spotify.Save(filepath); err != nil {
-			return nil, err
+	return spotify, nil
+}
+
+// Init saves the token file if it has moved, and sets the current user if
+// it is unknown. Settings such as APIURL must be made between Load and Init,
+// as Init may make requests.
+func (spotify *Spotify) Init() error {
+	if spotify.moved {
+		if err := spotify.Save(spotify.Auth.TokenFile); err != nil {
+			return err
 		}
+		spotify.moved = false
 	}
 	if spotify.Profile.Id == "" {
-		if err := spotify.SetCurrentUser(); err != nil {
-			return nil, err
-		}
+		return spotify.SetCurrentUser()
 	}
-	return &spotify, nil
+	return nil
 }
 
 func (spotify *Spotify) CurrentUser() (*Profile, error) {
-	url := "https://api.spotify.com/v1/me"
+	url := spotify.apiURL() + "/me"
 	body, err := spotify.get(url)
 	if err != nil {
 		return nil, err
@@ -257,22 +464,21 @@ func (spotify *Spotify) CurrentUser() (*Profile, error) {
 	return &profile, nil
 }
 
+// Playlists returns all playlists of the current user, reading every page.
 func (spotify *Spotify) Playlists() ([]Playlist, error) {
-	url := fmt.Sprintf("https://api.spotify.com/v1/users/%s/playlists",
-		spotify.Profile.Id)
-	body, err := spotify.get(url)
-	if err != nil {
-		return nil, err
+	var playlists []Playlist
+	pager := spotify.PlaylistPager()
+	for pager.Next() {
+		playlists = append(playlists, pager.Page().Items...)
 	}
-	var playlists Playlists
-	if err := json.Unmarshal(body, &playlists); err != nil {
+	if err := pager.Err(); err != nil {
 		return nil, err
 	}
-	return playlists.Items, nil
+	return playlists, nil
 }
 
 func (spotify *Spotify) PlaylistById(playlistId string) (*Playlist, error) {
-	url := fmt.Sprintf("https://api.spotify.com/v1/users/%s/playlists/%s",
+	url := fmt.Sprintf("%s/users/%s/playlists/%s", spotify.apiURL(),
 		spotify.Profile.Id, playlistId)
 	body, err := spotify.get(url)
 	if err != nil {
@@ -311,7 +517,7 @@ func (spotify *Spotify) GetOrCreatePlaylist(name string) (*Playlist, error) {
 	if existing != nil {
 		return existing, nil
 	}
-	url := fmt.Sprintf("https://api.spotify.com/v1/users/%s/playlists",
+	url := fmt.Sprintf("%s/users/%s/playlists", spotify.apiURL(),
 		spotify.Profile.Id)
 	newPlaylist, err := json.Marshal(NewPlaylist{
 		Name:   name,
@@ -331,61 +537,68 @@ func (spotify *Spotify) GetOrCreatePlaylist(name string) (*Playlist, error) {
 	return &playlist, err
 }
 
-func (spotify *Spotify) RecentTracks(playlist *Playlist,
-	n int) ([]PlaylistTrack, error) {
-	// If playlist has <= 100 tracks, return the last n tracks without doing
-	// another request
-	if playlist.Tracks.Total <= 100 {
-		offset := len(playlist.Tracks.Items) - n
-		if offset > 0 {
-			return playlist.Tracks.Items[offset:], nil
-		}
-		return playlist.Tracks.Items, nil
+// PlaylistSnapshot returns the current snapshot ID of playlist.
+func (spotify *Spotify) PlaylistSnapshot(playlist *Playlist) (string,
+	error) {
+	url := fmt.Sprintf("%s/users/%s/playlists/%s?fields=snapshot_id",
+		spotify.apiURL(), spotify.Profile.Id, playlist.Id)
+	body, err := spotify.get(url)
+	if err != nil {
+		return "", err
 	}
-
-	offset := playlist.Tracks.Total - n
-	if offset < 0 {
-		offset = 0
+	var s snapshot
+	if err := json.Unmarshal(body, &s); err != nil {
+		return "", err
 	}
-	params := url.Values{"offset": {strconv.Itoa(offset)}}
-	url := fmt.Sprintf(
-		"https://api.spotify.com/v1/users/%s/playlists/%s/tracks?",
-		spotify.Profile.Id, playlist.Id)
+	return s.SnapshotId, nil
+}
 
-	tracks := make([]PlaylistTrack, 0, n)
-	nextUrl := url + params.Encode()
-	for nextUrl != "" {
-		body, err := spotify.get(nextUrl)
-		if err != nil {
-			return nil, err
-		}
-		var playlistTracks PlaylistTracks
-		if err := json.Unmarshal(body, &playlistTracks); err != nil {
-			return nil, err
-		}
-		tracks = append(tracks, playlistTracks.Items...)
-		nextUrl = playlistTracks.Next
+// PlaylistTracks returns all tracks of playlist, reading every page.
+func (spotify *Spotify) PlaylistTracks(playlist *Playlist) ([]PlaylistTrack,
+	error) {
+	var tracks []PlaylistTrack
+	pager := spotify.PlaylistTrackPager(playlist, 0)
+	for pager.Next() {
+		tracks = append(tracks, pager.Page().Items...)
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
 	}
 	return tracks, nil
 }
 
+// updateSnapshot sets the snapshot ID of playlist from the response body of
+// a successful change to it. The change is not an error if the body has no
+// snapshot, as retrying it would repeat the change. The snapshot is unknown
+// instead, so that the playlist is read again.
+func (playlist *Playlist) updateSnapshot(body []byte) {
+	var s snapshot
+	if err := json.Unmarshal(body, &s); err != nil {
+		s.SnapshotId = ""
+	}
+	playlist.SnapshotId = s.SnapshotId
+}
+
+// Search returns at most limit results of searching for query, reading as
+// many pages as needed.
 func (spotify *Spotify) Search(query string, types string, limit int) ([]Track,
 	error) {
-	params := url.Values{
-		"q":     {query},
-		"type":  {types},
-		"limit": {strconv.Itoa(limit)},
+	pageLimit := limit
+	if pageLimit > maxSearchLimit {
+		pageLimit = maxSearchLimit
 	}
-	url := "https://api.spotify.com/v1/search?" + params.Encode()
-	body, err := spotify.get(url)
-	if err != nil {
-		return nil, err
+	var tracks []Track
+	pager := spotify.SearchPager(query, types, pageLimit)
+	for len(tracks) < limit && pager.Next() {
+		tracks = append(tracks, pager.Page().Tracks.Items...)
 	}
-	var result SearchResult
-	if err := json.Unmarshal(body, &result); err != nil {
+	if err := pager.Err(); err != nil {
 		return nil, err
 	}
-	return result.Tracks.Items, nil
+	if len(tracks) > limit {
+		tracks = tracks[:limit]
+	}
+	return tracks, nil
 }
 
 func (spotify *Spotify) SearchArtistTrack(artist string, track string) ([]Track,
@@ -399,9 +612,8 @@ func (spotify *Spotify) SearchArtistTrack(artist string, track string) ([]Track,
 }
 
 func (spotify *Spotify) AddTracks(playlist *Playlist, tracks []Track) error {
-	url := fmt.Sprintf(
-		"https://api.spotify.com/v1/users/%s/playlists/%s/tracks",
-		spotify.Profile.Id, playlist.Id)
+	url := fmt.Sprintf("%s/users/%s/playlists/%s/tracks",
+		spotify.apiURL(), spotify.Profile.Id, playlist.Id)
 
 	uris := make([]string, len(tracks))
 	for i, track := range tracks {
@@ -411,9 +623,51 @@ func (spotify *Spotify) AddTracks(playlist *Playlist, tracks []Track) error {
 	if err != nil {
 		return err
 	}
-	if _, err := spotify.post(url, jsonUris); err != nil {
+	body, err := spotify.post(url, jsonUris)
+	if err != nil {
 		return err
 	}
+	playlist.updateSnapshot(body)
+	return nil
+}
+
+// maxTracksPerRequest is the number of tracks which can be added to a
+// playlist in one request.
+const maxTracksPerRequest = 100
+
+// ReplaceTracks replaces the tracks of playlist with tracks, in order.
+func (spotify *Spotify) ReplaceTracks(playlist *Playlist,
+	tracks []Track) error {
+	url := fmt.Sprintf("%s/users/%s/playlists/%s/tracks",
+		spotify.apiURL(), spotify.Profile.Id, playlist.Id)
+	n := len(tracks)
+	if n > maxTracksPerRequest {
+		n = maxTracksPerRequest
+	}
+	uris := make([]string, n)
+	for i, track := range tracks[:n] {
+		uris[i] = track.Uri
+	}
+	jsonUris, err := json.Marshal(map[string][]string{"uris": uris})
+	if err != nil {
+		return err
+	}
+	body, err := spotify.put(url, jsonUris)
+	if err != nil {
+		return err
+	}
+	playlist.updateSnapshot(body)
+	// The tracks which do not fit in the replacing request are appended
+	for i := n; i < len(tracks); i += maxTracksPerRequest {
+		end := i + maxTracksPerRequest
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		err := spotify.AddTracks(playlist, tracks[i:end])
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -438,9 +692,8 @@ func (spotify *Spotify) SetCurrentUser() error {
 }
 
 func (spotify *Spotify) DeleteTracks(playlist *Playlist, tracks []Track) error {
-	url := fmt.Sprintf(
-		"https://api.spotify.com/v1/users/%s/playlists/%s/tracks",
-		spotify.Profile.Id, playlist.Id)
+	url := fmt.Sprintf("%s/users/%s/playlists/%s/tracks",
+		spotify.apiURL(), spotify.Profile.Id, playlist.Id)
 
 	uris := make([]map[string]string, len(tracks))
 	for i, track := range tracks {
@@ -455,9 +708,11 @@ func (spotify *Spotify) DeleteTracks(playlist *Playlist, tracks []Track) error {
 	if err != nil {
 		return err
 	}
-	if _, err := spotify.delete(url, jsonUris); err != nil {
+	body, err := spotify.delete(url, jsonUris)
+	if err != nil {
 		return err
 	}
+	playlist.updateSnapshot(body)
 	return nil
 }
 
@@ -2,6 +2,7 @@ package spotify
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/colorstring"
 )
@@ -17,6 +20,17 @@ const defaultAuthURL string = "https://accounts.spotify.com"
 const stateKey string = "spotify_auth_state"
 const scope string = "playlist-modify-public playlist-modify-private " +
 	"playlist-read-private"
+const stateTTL = 10 * time.Minute
+
+var oauthErrors = map[string]string{
+	"access_denied":             "access was denied",
+	"invalid_request":           "the request was invalid",
+	"invalid_scope":             "the requested scope is invalid",
+	"server_error":              "Spotify encountered an error",
+	"temporarily_unavailable":   "Spotify is temporarily unavailable",
+	"unauthorized_client":       "the client is not authorized",
+	"unsupported_response_type": "the response type is not supported",
+}
 
 type Auth struct {
 	ClientId     string `json:"client_id"`
@@ -25,6 +39,54 @@ type Auth struct {
 	listen       string
 	listenURL    string
 	url          string
+	states       *stateStore
+}
+
+type stateStore struct {
+	mu     sync.Mutex
+	states map[string]time.Time
+	now    func() time.Time
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{
+		states: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+func (store *stateStore) add(state string) time.Time {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.now()
+	for s, expires := range store.states {
+		if !now.Before(expires) {
+			delete(store.states, s)
+		}
+	}
+	expires := now.Add(stateTTL)
+	store.states[state] = expires
+	return expires
+}
+
+// consume returns true if state is known and has not expired. A state can
+// only be consumed once.
+func (store *stateStore) consume(state string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.now()
+	found := ""
+	for s := range store.states {
+		if subtle.ConstantTimeCompare([]byte(s), []byte(state)) == 1 {
+			found = s
+		}
+	}
+	if found == "" {
+		return false
+	}
+	expires := store.states[found]
+	delete(store.states, found)
+	return now.Before(expires)
 }
 
 func (auth *Auth) URL() string {
@@ -48,6 +110,32 @@ func (auth *Auth) CallbackURL() string {
 	return auth.ListenURL() + "/callback"
 }
 
+func (auth *Auth) stateStore() *stateStore {
+	if auth.states == nil {
+		auth.states = newStateStore()
+	}
+	return auth.states
+}
+
+func (auth *Auth) stateCookie(value string, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     stateKey,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		// Lax is required as the callback is a cross-site redirect
+		SameSite: http.SameSiteLaxMode,
+		Secure:   strings.HasPrefix(auth.ListenURL(), "https://"),
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+		cookie.MaxAge = int(stateTTL.Seconds())
+	}
+	return cookie
+}
+
 func (auth *Auth) authHeader() string {
 	data := auth.ClientId + ":" + auth.ClientSecret
 	return "Basic " + base64.StdEncoding.EncodeToString(
@@ -60,7 +148,7 @@ func base64Rand(size int) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return base64.StdEncoding.EncodeToString(b), nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 func (auth *Auth) Login(w http.ResponseWriter, r *http.Request) {
@@ -69,10 +157,8 @@ func (auth *Auth) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to generate state value", 400)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:  stateKey,
-		Value: state,
-	})
+	expires := auth.stateStore().add(state)
+	http.SetCookie(w, auth.stateCookie(state, expires))
 	params := url.Values{
 		"response_type": {"code"},
 		"client_id":     {auth.ClientId},
@@ -106,21 +192,45 @@ func (auth *Auth) getToken(code []string) (*Spotify, error) {
 	if err := json.Unmarshal(body, &token); err != nil {
 		return nil, err
 	}
+	token.setExpiry(time.Now())
 	return &Spotify{
 		Auth:  *auth,
 		Token: token,
 	}, nil
 }
 
+func oauthError(params url.Values) string {
+	code := params.Get("error")
+	msg, ok := oauthErrors[code]
+	if !ok {
+		msg = "unknown error"
+	}
+	msg = fmt.Sprintf("Authorization failed: %s (%s)", msg, code)
+	if description := params.Get("error_description"); description != "" {
+		msg += ": " + description
+	}
+	return msg
+}
+
 func (auth *Auth) Callback(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
-	state := params["state"]
+	state := params.Get("state")
 	cookie, _ := r.Cookie(stateKey)
+	// Always invalidate state, regardless of the outcome
+	valid := state != "" && auth.stateStore().consume(state)
+	http.SetCookie(w, auth.stateCookie("", time.Time{}))
 
-	if state == nil || cookie == nil || cookie.Value != state[0] {
+	if !valid || cookie == nil || subtle.ConstantTimeCompare(
+		[]byte(cookie.Value), []byte(state)) != 1 {
 		http.Error(w, "Could not validate request", 400)
 		return
 	}
+	// Errors are only shown for requests we initiated, so that nobody
+	// else can make us render their text
+	if params.Get("error") != "" {
+		http.Error(w, oauthError(params), 400)
+		return
+	}
 
 	code, exists := params["code"]
 	if !exists {
@@ -143,6 +253,7 @@ func (auth *Auth) Callback(w http.ResponseWriter, r *http.Request) {
 
 func (auth *Auth) Serve(listen string) error {
 	auth.listen = listen
+	auth.stateStore()
 	http.HandleFunc("/login", auth.Login)
 	http.HandleFunc("/callback", auth.Callback)
 	fmt.Printf(colorstring.Color(
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestURL(t *testing.T) {
@@ -98,6 +99,15 @@ func TestLogin(t *testing.T) {
 	if cookie.Name != "spotify_auth_state" || len(cookie.Value) == 0 {
 		t.Fatal("Cookie 'spotify_auth_state' not set")
 	}
+	if !cookie.HttpOnly {
+		t.Fatal("Expected cookie to be HttpOnly")
+	}
+	if cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected SameSite=Lax, got %d", cookie.SameSite)
+	}
+	if cookie.MaxAge != 600 {
+		t.Fatalf("Expected MaxAge 600, got %d", cookie.MaxAge)
+	}
 	location := resp.Header.Get("Location")
 	u, err := url.Parse(location)
 	if err != nil {
@@ -131,6 +141,41 @@ func TestLogin(t *testing.T) {
 	if values["state"] == nil {
 		t.Fatalf("Expected 'state' to be set")
 	}
+	if values["state"][0] != cookie.Value {
+		t.Fatalf("Expected state %s, got %s", cookie.Value,
+			values["state"][0])
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	store := newStateStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.add("foo")
+	if store.consume("bar") {
+		t.Fatal("Expected unknown state to be rejected")
+	}
+	if !store.consume("foo") {
+		t.Fatal("Expected state to be accepted")
+	}
+	if store.consume("foo") {
+		t.Fatal("Expected state to be accepted only once")
+	}
+
+	store.add("foo")
+	now = now.Add(stateTTL)
+	if store.consume("foo") {
+		t.Fatal("Expected expired state to be rejected")
+	}
+
+	store.add("foo")
+	now = now.Add(stateTTL)
+	store.add("bar")
+	if len(store.states) != 1 {
+		t.Fatalf("Expected expired states to be purged, got %d",
+			len(store.states))
+	}
 }
 
 func TestGetToken(t *testing.T) {
@@ -163,19 +208,24 @@ func TestGetToken(t *testing.T) {
 		t.Fatalf("Expected '%s', got '%s'",
 			expected, spotify.Token.RefreshToken)
 	}
+	expected = "playlist-modify-public playlist-modify-private"
+	if spotify.Token.Scope != expected {
+		t.Fatalf("Expected '%s', got '%s'",
+			expected, spotify.Token.Scope)
+	}
+	lifetime := spotify.Token.ExpiresAt.Sub(spotify.Token.RefreshedAt)
+	if lifetime != time.Hour {
+		t.Fatalf("Expected token lifetime %s, got %s", time.Hour,
+			lifetime)
+	}
 }
 
-func TestCallback(t *testing.T) {
+func newCallbackServer(t *testing.T) (*Auth, func()) {
 	tempFile, err := ioutil.TempFile("", "spotify_auth")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := os.Remove(tempFile.Name()); err != nil {
-			t.Fatal(err)
-		}
-	}()
-	auth := Auth{
+	auth := &Auth{
 		ClientId:     "foo",
 		ClientSecret: "bar",
 		TokenFile:    tempFile.Name(),
@@ -188,20 +238,28 @@ func TestCallback(t *testing.T) {
 	mux.HandleFunc("/api/token", tokenHandler)
 	mux.HandleFunc("/callback", auth.Callback)
 	server := httptest.NewServer(mux)
-	defer server.Close()
 
 	auth.listenURL = server.URL
 	auth.url = server.URL
 
-	req, err := http.NewRequest("GET",
-		auth.CallbackURL()+"?code=foobar&state=secret", nil)
-	req.AddCookie(&http.Cookie{
-		Name:  "spotify_auth_state",
-		Value: "secret",
-	})
+	return auth, func() {
+		server.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func callback(t *testing.T, auth *Auth, query string,
+	state string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", auth.CallbackURL()+"?"+query, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.AddCookie(&http.Cookie{
+		Name:  "spotify_auth_state",
+		Value: state,
+	})
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -212,9 +270,85 @@ func TestCallback(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	return resp, string(body)
+}
+
+func TestCallback(t *testing.T) {
+	auth, cleanup := newCallbackServer(t)
+	defer cleanup()
+
+	auth.stateStore().add("secret")
+	resp, body := callback(t, auth, "code=foobar&state=secret", "secret")
 	if resp.StatusCode != 200 {
 		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
 	}
+	cookies := resp.Cookies()
+	if len(cookies) == 0 || cookies[0].MaxAge >= 0 {
+		t.Fatal("Expected state cookie to be cleared")
+	}
+
+	// State can only be used once
+	resp, body = callback(t, auth, "code=foobar&state=secret", "secret")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCallbackInvalidState(t *testing.T) {
+	auth, cleanup := newCallbackServer(t)
+	defer cleanup()
+
+	// Unknown state
+	resp, body := callback(t, auth, "code=foobar&state=secret", "secret")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+
+	// Cookie mismatch
+	auth.stateStore().add("secret")
+	resp, body = callback(t, auth, "code=foobar&state=secret", "other")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+
+	// Expired state
+	auth.stateStore().add("secret")
+	auth.stateStore().now = func() time.Time {
+		return time.Now().Add(stateTTL)
+	}
+	resp, body = callback(t, auth, "code=foobar&state=secret", "secret")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCallbackError(t *testing.T) {
+	auth, cleanup := newCallbackServer(t)
+	defer cleanup()
+
+	auth.stateStore().add("secret")
+	resp, body := callback(t, auth, "error=access_denied&state=secret",
+		"secret")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+	expected := "Authorization failed: access was denied (access_denied)\n"
+	if body != expected {
+		t.Fatalf("Expected %q, got %q", expected, body)
+	}
+	if len(auth.stateStore().states) != 0 {
+		t.Fatal("Expected state to be invalidated")
+	}
+
+	// Errors of requests with invalid state are not shown
+	resp, body = callback(t, auth, "error=access_denied&"+
+		"error_description=Call+555-0100&state=other", "other")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %d: %s", resp.StatusCode, body)
+	}
+	if expected := "Could not validate request\n"; body != expected {
+		t.Fatalf("Expected %q, got %q", expected, body)
+	}
 }
 
 const tokenResponse string = `
@@ -222,5 +356,6 @@ const tokenResponse string = `
    "access_token": "NgCXRK...MzYjw",
    "token_type": "Bearer",
    "expires_in": 3600,
-   "refresh_token": "NgAagA...Um_SHo"
+   "refresh_token": "NgAagA...Um_SHo",
+   "scope": "playlist-modify-public playlist-modify-private"
 }`
@@ -0,0 +1,631 @@
+package spotify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenExpired(t *testing.T) {
+	token := Token{}
+	now := time.Now()
+	if token.Expired(now) {
+		t.Fatal("Expected token without expiry to not be expired")
+	}
+	token.ExpiresIn = 3600
+	token.setExpiry(now)
+	if token.Expired(now) {
+		t.Fatal("Expected token to not be expired")
+	}
+	if !token.Expired(now.Add(time.Hour)) {
+		t.Fatal("Expected token to be expired")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "spotify_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spotify := Spotify{
+		Token: Token{AccessToken: "foo", RefreshToken: "bar"},
+		Auth:  Auth{TokenFile: tempFile.Name()},
+	}
+	if err := spotify.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if spotify.AccessToken != "" || spotify.RefreshToken != "" {
+		t.Fatal("Expected token to be cleared")
+	}
+	if _, err := os.Stat(tempFile.Name()); !os.IsNotExist(err) {
+		t.Fatal("Expected token file to be removed")
+	}
+}
+
+type testRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   string
+}
+
+type testAPI struct {
+	server   *httptest.Server
+	mux      *http.ServeMux
+	requests []testRequest
+}
+
+func newTestAPI() *testAPI {
+	api := &testAPI{mux: http.NewServeMux()}
+	api.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			api.requests = append(api.requests, testRequest{
+				Method: r.Method,
+				Path:   r.URL.Path,
+				Query:  r.URL.Query(),
+				Body:   string(body),
+			})
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			api.mux.ServeHTTP(w, r)
+		}))
+	return api
+}
+
+func (api *testAPI) handle(path string, status int, body string) {
+	api.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+}
+
+func (api *testAPI) spotify() *Spotify {
+	return &Spotify{
+		Token: Token{
+			AccessToken:  "foo",
+			TokenType:    "Bearer",
+			RefreshToken: "bar",
+		},
+		Profile:     Profile{Id: "gopher"},
+		APIURL:      api.server.URL + "/v1",
+		AccountsURL: api.server.URL,
+		Client:      api.server.Client(),
+	}
+}
+
+func (api *testAPI) lastRequest(t *testing.T) testRequest {
+	if len(api.requests) == 0 {
+		t.Fatal("Expected at least one request")
+	}
+	return api.requests[len(api.requests)-1]
+}
+
+func TestAPIURL(t *testing.T) {
+	spotify := Spotify{}
+	if url := spotify.apiURL(); url != "https://api.spotify.com/v1" {
+		t.Fatalf("Expected https://api.spotify.com/v1, got %s", url)
+	}
+	if url := spotify.accountsURL(); url != "https://accounts.spotify.com" {
+		t.Fatalf("Expected https://accounts.spotify.com, got %s", url)
+	}
+	if spotify.httpClient() != client {
+		t.Fatal("Expected default client")
+	}
+	spotify = Spotify{
+		APIURL:      "http://127.0.0.1/v1",
+		AccountsURL: "http://127.0.0.1",
+	}
+	if url := spotify.apiURL(); url != "http://127.0.0.1/v1" {
+		t.Fatalf("Expected http://127.0.0.1/v1, got %s", url)
+	}
+	if url := spotify.accountsURL(); url != "http://127.0.0.1" {
+		t.Fatalf("Expected http://127.0.0.1, got %s", url)
+	}
+}
+
+func TestCurrentUser(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/me", 200, profileResponse)
+
+	profile, err := api.spotify().CurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Id != "gopher" {
+		t.Fatalf("Expected gopher, got %s", profile.Id)
+	}
+	req := api.lastRequest(t)
+	if req.Method != "GET" || req.Path != "/v1/me" {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+}
+
+func TestSetCurrentUser(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/me", 200, profileResponse)
+	tempFile, err := ioutil.TempFile("", "spotify_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	spotify := api.spotify()
+	spotify.Profile = Profile{}
+	spotify.Auth.TokenFile = tempFile.Name()
+	if err := spotify.SetCurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	if spotify.Profile.Id != "gopher" {
+		t.Fatalf("Expected gopher, got %s", spotify.Profile.Id)
+	}
+	saved, err := New(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Profile.Id != "gopher" {
+		t.Fatalf("Expected saved profile gopher, got %s",
+			saved.Profile.Id)
+	}
+	if saved.APIURL != "" || saved.AccountsURL != "" {
+		t.Fatalf("Expected URLs to not be saved, got %s and %s",
+			saved.APIURL, saved.AccountsURL)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "spotify_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	spotify := Spotify{
+		Auth:    Auth{TokenFile: "/moved/token.json"},
+		Profile: Profile{Id: "gopher"},
+	}
+	if err := spotify.Save(tempFile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := New(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Auth.TokenFile != tempFile.Name() {
+		t.Fatalf("Expected token file %s, got %s", tempFile.Name(),
+			loaded.Auth.TokenFile)
+	}
+	if _, err := New("/non-existent/token.json"); err == nil {
+		t.Fatal("Expected error for missing token file")
+	}
+}
+
+func TestPlaylists(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists", 200, playlistsResponse)
+
+	playlists, err := api.spotify().Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 2 {
+		t.Fatalf("Expected 2 playlists, got %d", len(playlists))
+	}
+	if playlists[0].Name != "NRK P3" || playlists[1].Name != "NRK mP3" {
+		t.Fatalf("Unexpected playlists: %+v", playlists)
+	}
+}
+
+func TestPlaylistsPaginated(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	path := "/v1/users/gopher/playlists"
+	api.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") == "1" {
+			fmt.Fprint(w, `{"items": [{"id": "p13"}],
+                                "next": null}`)
+			return
+		}
+		fmt.Fprintf(w, `{"items": [{"id": "p3"}],
+                                 "next": "%s%s?offset=1"}`,
+			api.server.URL, path)
+	})
+
+	playlists, err := api.spotify().Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 2 || playlists[0].Id != "p3" ||
+		playlists[1].Id != "p13" {
+		t.Fatalf("Unexpected playlists: %+v", playlists)
+	}
+	if len(api.requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(api.requests))
+	}
+}
+
+func TestPlaylistById(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists/p3", 200, playlistResponse)
+
+	playlist, err := api.spotify().PlaylistById("p3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "NRK P3 (p3) [2 songs]"
+	if playlist.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, playlist.String())
+	}
+	if !playlist.Contains(Track{Id: "track1"}) {
+		t.Fatal("Expected playlist to contain track1")
+	}
+	if playlist.Contains(Track{Id: "track3"}) {
+		t.Fatal("Expected playlist to not contain track3")
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists", 200, playlistsResponse)
+	api.handle("/v1/users/gopher/playlists/p3", 200, playlistResponse)
+
+	spotify := api.spotify()
+	playlist, err := spotify.Playlist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist == nil || playlist.Id != "p3" {
+		t.Fatalf("Expected playlist p3, got %+v", playlist)
+	}
+	playlist, err = spotify.Playlist("NRK P13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist != nil {
+		t.Fatalf("Expected no playlist, got %+v", playlist)
+	}
+}
+
+func TestGetOrCreatePlaylist(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.mux.HandleFunc("/v1/users/gopher/playlists",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				w.WriteHeader(201)
+				fmt.Fprint(w, `{"id": "p13", "name": "NRK P13"}`)
+				return
+			}
+			fmt.Fprint(w, playlistsResponse)
+		})
+	api.handle("/v1/users/gopher/playlists/p3", 200, playlistResponse)
+
+	spotify := api.spotify()
+	playlist, err := spotify.GetOrCreatePlaylist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.Id != "p3" {
+		t.Fatalf("Expected existing playlist p3, got %s", playlist.Id)
+	}
+
+	playlist, err = spotify.GetOrCreatePlaylist("NRK P13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.Id != "p13" {
+		t.Fatalf("Expected new playlist p13, got %s", playlist.Id)
+	}
+	req := api.lastRequest(t)
+	if req.Method != "POST" {
+		t.Fatalf("Expected POST, got %s", req.Method)
+	}
+	var newPlaylist NewPlaylist
+	if err := json.Unmarshal([]byte(req.Body), &newPlaylist); err != nil {
+		t.Fatal(err)
+	}
+	if newPlaylist.Name != "NRK P13" || newPlaylist.Public {
+		t.Fatalf("Unexpected playlist: %+v", newPlaylist)
+	}
+}
+
+func TestSearchArtistTrack(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/search", 200, searchResponse)
+
+	tracks, err := api.spotify().SearchArtistTrack("Bob Dylan",
+		"Like a Rolling Stone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].Id != "3AhXZa8sUQht0UEdBJgpGc" {
+		t.Fatalf("Unexpected tracks: %+v", tracks)
+	}
+	query := api.lastRequest(t).Query
+	expected := "artist:Bob Dylan track:Like a Rolling Stone"
+	if query.Get("q") != expected {
+		t.Fatalf("Expected %s, got %s", expected, query.Get("q"))
+	}
+	if query.Get("type") != "track" || query.Get("limit") != "1" {
+		t.Fatalf("Unexpected query: %s", query.Encode())
+	}
+}
+
+func TestSearchPaginated(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	path := "/v1/search"
+	api.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") == "2" {
+			fmt.Fprint(w, `{"tracks": {"items": [{"id": "3"},
+                                {"id": "4"}], "next": null}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"tracks": {"items": [{"id": "1"}, {"id": "2"}],
+                                 "next": "%s%s?offset=2"}}`,
+			api.server.URL, path)
+	})
+
+	tracks, err := api.spotify().Search("Bob Dylan", "track", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 3 || tracks[0].Id != "1" || tracks[2].Id != "3" {
+		t.Fatalf("Unexpected tracks: %+v", tracks)
+	}
+
+	// Pages are only read until limit is reached
+	api.requests = nil
+	if _, err := api.spotify().Search("Bob Dylan", "track", 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(api.requests))
+	}
+}
+
+func TestAddTracks(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists/p3/tracks", 201,
+		`{"snapshot_id": "1"}`)
+
+	playlist := Playlist{Id: "p3"}
+	tracks := []Track{{Uri: "spotify:track:1"}, {Uri: "spotify:track:2"}}
+	if err := api.spotify().AddTracks(&playlist, tracks); err != nil {
+		t.Fatal(err)
+	}
+	req := api.lastRequest(t)
+	expected := `["spotify:track:1","spotify:track:2"]`
+	if req.Method != "POST" || req.Body != expected {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+	if playlist.SnapshotId != "1" {
+		t.Fatalf("Expected snapshot 1, got %q", playlist.SnapshotId)
+	}
+	if err := api.spotify().AddTrack(&playlist, &tracks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if body := api.lastRequest(t).Body; body != `["spotify:track:1"]` {
+		t.Fatalf("Unexpected body: %s", body)
+	}
+}
+
+func TestAddTracksWithoutSnapshot(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists/p3/tracks", 201, "")
+
+	// The tracks were added, so the change must not fail and be retried
+	playlist := Playlist{Id: "p3", SnapshotId: "1"}
+	track := Track{Uri: "spotify:track:1"}
+	if err := api.spotify().AddTrack(&playlist, &track); err != nil {
+		t.Fatal(err)
+	}
+	if playlist.SnapshotId != "" {
+		t.Fatalf("Expected unknown snapshot, got %q",
+			playlist.SnapshotId)
+	}
+}
+
+func TestDeleteTracks(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/users/gopher/playlists/p3/tracks", 200,
+		`{"snapshot_id": "1"}`)
+
+	playlist := Playlist{Id: "p3"}
+	track := Track{Uri: "spotify:track:1"}
+	if err := api.spotify().DeleteTrack(&playlist, &track); err != nil {
+		t.Fatal(err)
+	}
+	req := api.lastRequest(t)
+	expected := `{"tracks":[{"uri":"spotify:track:1"}]}`
+	if req.Method != "DELETE" || req.Body != expected {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+}
+
+func TestRequestFailure(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/me", 500, `{"error": "gopher says no"}`)
+
+	_, err := api.spotify().CurrentUser()
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	expected := `request failed (500): {"error": "gopher says no"}`
+	if err.Error() != expected {
+		t.Fatalf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestRequestRefreshesToken(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.mux.HandleFunc("/v1/me", func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer NgCXRK...MzYjw" {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, profileResponse)
+	})
+	api.handle("/api/token", 200, tokenResponse)
+	tempFile, err := ioutil.TempFile("", "spotify_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	spotify := api.spotify()
+	spotify.Auth = Auth{
+		ClientId:     "foo",
+		ClientSecret: "bar",
+		TokenFile:    tempFile.Name(),
+	}
+	if _, err := spotify.CurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	if spotify.AccessToken != "NgCXRK...MzYjw" {
+		t.Fatalf("Expected refreshed access token, got %s",
+			spotify.AccessToken)
+	}
+	if spotify.RefreshedAt.IsZero() {
+		t.Fatal("Expected refresh time to be set")
+	}
+	if err := spotify.RefreshError(); err != nil {
+		t.Fatalf("Expected no refresh error, got %s", err)
+	}
+	tokenReq := api.requests[1]
+	if tokenReq.Path != "/api/token" ||
+		tokenReq.Body != "grant_type=refresh_token&refresh_token=bar" {
+		t.Fatalf("Unexpected token request: %+v", tokenReq)
+	}
+	saved, err := New(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "NgCXRK...MzYjw" {
+		t.Fatalf("Expected saved access token, got %s",
+			saved.AccessToken)
+	}
+}
+
+func TestRefreshFailure(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/api/token", 400, `{"error": "invalid_grant"}`)
+
+	spotify := api.spotify()
+	if err := spotify.Refresh(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if spotify.AccessToken != "foo" {
+		t.Fatalf("Expected access token to be unchanged, got %s",
+			spotify.AccessToken)
+	}
+	if spotify.RefreshError() == nil {
+		t.Fatal("Expected refresh error to be recorded")
+	}
+}
+
+func TestTokenStatus(t *testing.T) {
+	api := newTestAPI()
+	defer api.server.Close()
+	api.handle("/v1/me", 200, profileResponse)
+
+	spotify := api.spotify()
+	spotify.Scope = "playlist-read-private"
+	status := spotify.TokenStatus()
+	if !status.Valid || status.Error != "" {
+		t.Fatalf("Expected valid token, got %+v", status)
+	}
+	if status.ProfileId != "gopher" || status.Scope != spotify.Scope {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if status.ExpiresAt != nil || status.RefreshedAt != nil {
+		t.Fatalf("Expected no expiry, got %+v", status)
+	}
+
+	// A rejected token is not refreshed
+	rejecting := newTestAPI()
+	defer rejecting.server.Close()
+	rejecting.handle("/v1/me", 401, `{"error": "invalid token"}`)
+	spotify.APIURL = rejecting.server.URL + "/v1"
+	spotify.AccountsURL = rejecting.server.URL
+	status = spotify.TokenStatus()
+	if status.Valid || status.Error == "" {
+		t.Fatalf("Expected invalid token, got %+v", status)
+	}
+	if n := len(rejecting.requests); n != 1 {
+		t.Fatalf("Expected 1 request, got %d", n)
+	}
+
+	// An expired token is not sent to the API
+	spotify.ExpiresAt = time.Now().Add(-time.Minute)
+	api.requests = nil
+	status = spotify.TokenStatus()
+	if status.Valid || !status.Expired || status.ExpiresAt == nil {
+		t.Fatalf("Expected expired token, got %+v", status)
+	}
+	if n := len(api.requests); n != 0 {
+		t.Fatalf("Expected no requests, got %d", n)
+	}
+}
+
+const profileResponse string = `
+{
+  "external_urls": {"spotify": "https://open.spotify.com/user/gopher"},
+  "href": "https://api.spotify.com/v1/users/gopher",
+  "id": "gopher",
+  "type": "user",
+  "uri": "spotify:user:gopher"
+}`
+
+const playlistsResponse string = `
+{
+  "items": [
+    {"id": "p3", "name": "NRK P3", "tracks": {"total": 2}},
+    {"id": "mp3", "name": "NRK mP3", "tracks": {"total": 0}}
+  ]
+}`
+
+const playlistResponse string = `
+{
+  "id": "p3",
+  "name": "NRK P3",
+  "tracks": {
+    "total": 2,
+    "items": [
+      {"track": {"id": "track1", "name": "A", "uri": "spotify:track:track1"}},
+      {"track": {"id": "track2", "name": "B", "uri": "spotify:track:track2"}}
+    ]
+  }
+}`
+
+const searchResponse string = `
+{
+  "tracks": {
+    "items": [
+      {
+        "id": "3AhXZa8sUQht0UEdBJgpGc",
+        "name": "Like a Rolling Stone",
+        "uri": "spotify:track:3AhXZa8sUQht0UEdBJgpGc"
+      }
+    ]
+  }
+}`
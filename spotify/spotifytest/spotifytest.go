@@ -0,0 +1,639 @@
+package spotifytest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+const defaultPageSize = 100
+
+var queryPattern = regexp.MustCompile("^artist:(.*) track:(.*)$")
+
+type Server struct {
+	ProfileId string
+	// URL is the base URL of the server. API endpoints are below URL/v1
+	URL string
+	// Latency is added to every request
+	Latency time.Duration
+	// PageSize is the maximum number of items returned per page
+	PageSize int
+	// AutoCatalog makes search return a track for every query, even if the
+	// track has not been added to the catalog
+	AutoCatalog bool
+	// Record keeps every request for Requests and Count. It is set by
+	// NewServer for tests, and left unset by long-running servers
+	Record bool
+
+	mu           sync.Mutex
+	server       *httptest.Server
+	accessToken  string
+	refreshToken string
+	tokens       int
+	playlists    []*playlist
+	catalog      []catalogTrack
+	failures     []*failure
+	requests     []Request
+}
+
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Body   string
+	Status int
+}
+
+type playlist struct {
+	spotify.Playlist
+	public   bool
+	snapshot int
+	tracks   []spotify.Track
+}
+
+type catalogTrack struct {
+	artist string
+	track  spotify.Track
+}
+
+type failure struct {
+	path   string
+	status int
+	times  int
+}
+
+type page struct {
+	Href     string      `json:"href"`
+	Items    interface{} `json:"items"`
+	Limit    int         `json:"limit"`
+	Next     *string     `json:"next"`
+	Offset   int         `json:"offset"`
+	Previous *string     `json:"previous"`
+	Total    int         `json:"total"`
+}
+
+type playlistJSON struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Public     bool   `json:"public"`
+	SnapshotId string `json:"snapshot_id"`
+	Tracks     page   `json:"tracks"`
+}
+
+func New() *Server {
+	return &Server{
+		ProfileId:    "gopher",
+		PageSize:     defaultPageSize,
+		accessToken:  "access-0",
+		refreshToken: "refresh",
+	}
+}
+
+// NewServer starts and returns a new fake server, which records requests. The
+// caller should call Close when finished.
+func NewServer() *Server {
+	s := New()
+	s.Record = true
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// Spotify returns a client configured to use this server.
+func (s *Server) Spotify() *spotify.Spotify {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &spotify.Spotify{
+		Token: spotify.Token{
+			AccessToken:  s.accessToken,
+			TokenType:    "Bearer",
+			RefreshToken: s.refreshToken,
+		},
+		Profile:     spotify.Profile{Id: s.ProfileId},
+		APIURL:      s.URL + "/v1",
+		AccountsURL: s.URL,
+	}
+	if s.server != nil {
+		c.Client = s.server.Client()
+	}
+	return c
+}
+
+// Sink returns a sink for the playlist named name, using this server.
+func (s *Server) Sink(name string) *spotify.Sink {
+	return spotify.NewSink(s.Spotify(), name)
+}
+
+// AddTrack adds a track to the catalog used for search.
+func (s *Server) AddTrack(artist, name string) spotify.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	track := newTrack(artist, name)
+	s.catalog = append(s.catalog, catalogTrack{artist: artist, track: track})
+	return track
+}
+
+// Fail makes the next times requests with a path starting with path fail
+// with status.
+func (s *Server) Fail(path string, status int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{
+		path:   path,
+		status: status,
+		times:  times,
+	})
+}
+
+// ExpireToken invalidates the current access token, forcing clients to
+// refresh it.
+func (s *Server) ExpireToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens++
+	s.accessToken = fmt.Sprintf("access-%d", s.tokens)
+}
+
+// Requests returns the recorded requests, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// Count returns the number of requests matching method and path prefix.
+func (s *Server) Count(method, path string) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if r.Method == method && strings.HasPrefix(r.Path, path) {
+			n++
+		}
+	}
+	return n
+}
+
+// Tracks returns the tracks of the playlist named name, in playlist order.
+func (s *Server) Tracks(name string) []spotify.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.playlists {
+		if p.Name == name {
+			tracks := make([]spotify.Track, len(p.tracks))
+			copy(tracks, p.tracks)
+			return tracks
+		}
+	}
+	return nil
+}
+
+// CreatePlaylist creates a playlist named name containing tracks.
+func (s *Server) CreatePlaylist(name string, tracks ...spotify.Track) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.createPlaylist(name, false)
+	p.tracks = append(p.tracks, tracks...)
+	return p.Id
+}
+
+func newTrack(artist, name string) spotify.Track {
+	sum := sha1.Sum([]byte(strings.ToLower(artist + "\x00" + name)))
+	id := hex.EncodeToString(sum[:])[:22]
+	return spotify.Track{Id: id, Name: name, Uri: "spotify:track:" + id}
+}
+
+func (s *Server) createPlaylist(name string, public bool) *playlist {
+	p := &playlist{public: public}
+	p.Id = fmt.Sprintf("playlist%d", len(s.playlists)+1)
+	p.Name = name
+	s.playlists = append(s.playlists, p)
+	return p
+}
+
+func (s *Server) playlist(id string) *playlist {
+	for _, p := range s.playlists {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) pageSize() int {
+	if s.PageSize <= 0 {
+		return defaultPageSize
+	}
+	return s.PageSize
+}
+
+func (s *Server) page(r *http.Request, path string,
+	items []interface{}) page {
+	limit := s.pageSize()
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil &&
+		n > 0 && n < limit {
+		limit = n
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	// Links to pages of the requested resource keep its query, such as
+	// the search query
+	params := url.Values{}
+	if path == r.URL.Path {
+		params = r.URL.Query()
+	}
+	href := func(offset int) *string {
+		params.Set("offset", strconv.Itoa(offset))
+		params.Set("limit", strconv.Itoa(limit))
+		u := s.URL + path + "?" + params.Encode()
+		return &u
+	}
+	p := page{
+		Href:   *href(offset),
+		Items:  items[offset:end],
+		Limit:  limit,
+		Offset: offset,
+		Total:  len(items),
+	}
+	if end < len(items) {
+		p.Next = href(end)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		p.Previous = href(prev)
+	}
+	return p
+}
+
+func (p *playlist) json(s *Server, r *http.Request) playlistJSON {
+	path := fmt.Sprintf("/v1/users/%s/playlists/%s/tracks", s.ProfileId,
+		p.Id)
+	items := make([]interface{}, len(p.tracks))
+	for i, t := range p.tracks {
+		items[i] = spotify.PlaylistTrack{Track: t}
+	}
+	return playlistJSON{
+		Id:         p.Id,
+		Name:       p.Name,
+		Public:     p.public,
+		SnapshotId: strconv.Itoa(p.snapshot),
+		Tracks:     s.page(r, path, items),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.Latency)
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := &recorder{ResponseWriter: w, status: 200}
+	s.serve(rec, r, body)
+	if !s.Record {
+		return
+	}
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Body:   string(body),
+		Status: rec.status,
+	})
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"status":  status,
+			"message": message,
+		},
+	})
+}
+
+func (s *Server) fail(w http.ResponseWriter, r *http.Request) bool {
+	for i, f := range s.failures {
+		if !strings.HasPrefix(r.URL.Path, f.path) {
+			continue
+		}
+		f.times--
+		if f.times <= 0 {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+		}
+		if f.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeError(w, f.status, http.StatusText(f.status))
+		return true
+	}
+	return false
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	if s.fail(w, r) {
+		return
+	}
+	if r.URL.Path == "/api/token" {
+		s.serveToken(w, r, body)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeError(w, 404, "Not found")
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+s.accessToken {
+		writeError(w, 401, "The access token expired")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[1:]
+	switch {
+	case len(parts) == 1 && parts[0] == "me":
+		s.serveProfile(w)
+	case len(parts) == 1 && parts[0] == "search":
+		s.serveSearch(w, r)
+	case len(parts) >= 3 && parts[0] == "users" && parts[2] == "playlists":
+		if parts[1] != s.ProfileId {
+			writeError(w, 403, "You cannot access playlists of "+
+				"another user")
+			return
+		}
+		s.servePlaylists(w, r, parts[3:], body)
+	default:
+		writeError(w, 404, "Not found")
+	}
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request,
+	body []byte) {
+	if r.Method != "POST" {
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+	form, err := parseForm(body)
+	if err != nil || form["grant_type"] != "refresh_token" ||
+		form["refresh_token"] != s.refreshToken {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	s.tokens++
+	s.accessToken = fmt.Sprintf("access-%d", s.tokens)
+	writeJSON(w, 200, spotify.Token{
+		AccessToken: s.accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   3600,
+		Scope: "playlist-modify-public playlist-modify-private " +
+			"playlist-read-private",
+	})
+}
+
+func parseForm(body []byte) (map[string]string, error) {
+	req, err := http.NewRequest("POST", "/", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	form := make(map[string]string)
+	for k := range req.PostForm {
+		form[k] = req.PostForm.Get(k)
+	}
+	return form, nil
+}
+
+func (s *Server) serveProfile(w http.ResponseWriter) {
+	writeJSON(w, 200, spotify.Profile{
+		Id:   s.ProfileId,
+		Href: s.URL + "/v1/users/" + s.ProfileId,
+		Type: "user",
+		Uri:  "spotify:user:" + s.ProfileId,
+	})
+}
+
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("type") != "track" {
+		writeError(w, 400, "Bad search type field")
+		return
+	}
+	matches := queryPattern.FindStringSubmatch(query.Get("q"))
+	items := []interface{}{}
+	if matches != nil {
+		artist := strings.ToLower(matches[1])
+		name := strings.ToLower(matches[2])
+		for _, t := range s.catalog {
+			if strings.Contains(strings.ToLower(t.artist), artist) &&
+				strings.Contains(strings.ToLower(t.track.Name),
+					name) {
+				items = append(items, t.track)
+			}
+		}
+		if len(items) == 0 && s.AutoCatalog {
+			items = append(items, newTrack(matches[1], matches[2]))
+		}
+	}
+	writeJSON(w, 200, map[string]page{
+		"tracks": s.page(r, r.URL.Path, items),
+	})
+}
+
+func (s *Server) servePlaylists(w http.ResponseWriter, r *http.Request,
+	parts []string, body []byte) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			items := make([]interface{}, len(s.playlists))
+			for i, p := range s.playlists {
+				item := p.json(s, r)
+				item.Tracks = page{Total: len(p.tracks)}
+				items[i] = item
+			}
+			writeJSON(w, 200, s.page(r, r.URL.Path, items))
+		case "POST":
+			var newPlaylist spotify.NewPlaylist
+			if err := json.Unmarshal(body, &newPlaylist); err != nil ||
+				newPlaylist.Name == "" {
+				writeError(w, 400, "Invalid playlist")
+				return
+			}
+			p := s.createPlaylist(newPlaylist.Name,
+				newPlaylist.Public)
+			writeJSON(w, 201, p.json(s, r))
+		default:
+			writeError(w, 405, "Method not allowed")
+		}
+		return
+	}
+	p := s.playlist(parts[0])
+	if p == nil {
+		writeError(w, 404, "Not found")
+		return
+	}
+	if len(parts) == 1 && r.Method == "GET" {
+		writeJSON(w, 200, p.json(s, r))
+		return
+	}
+	if len(parts) != 2 || parts[1] != "tracks" {
+		writeError(w, 404, "Not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, p.json(s, r).Tracks)
+	case "POST":
+		s.addTracks(w, r, p, body)
+	case "PUT":
+		s.replaceTracks(w, r, p, body)
+	case "DELETE":
+		s.deleteTracks(w, p, body)
+	default:
+		writeError(w, 405, "Method not allowed")
+	}
+}
+
+func parseURIs(r *http.Request, body []byte) ([]string, error) {
+	if uris := r.URL.Query().Get("uris"); uris != "" {
+		return strings.Split(uris, ","), nil
+	}
+	var uris []string
+	if err := json.Unmarshal(body, &uris); err == nil {
+		return uris, nil
+	}
+	var object struct {
+		Uris []string `json:"uris"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+	return object.Uris, nil
+}
+
+func (s *Server) track(uri string) spotify.Track {
+	for _, t := range s.catalog {
+		if t.track.Uri == uri {
+			return t.track
+		}
+	}
+	id := strings.TrimPrefix(uri, "spotify:track:")
+	return spotify.Track{Id: id, Uri: uri}
+}
+
+func (s *Server) addTracks(w http.ResponseWriter, r *http.Request,
+	p *playlist, body []byte) {
+	uris, err := parseURIs(r, body)
+	if err != nil || len(uris) == 0 || len(uris) > 100 {
+		writeError(w, 400, "Invalid track uris")
+		return
+	}
+	for _, uri := range uris {
+		p.tracks = append(p.tracks, s.track(uri))
+	}
+	p.snapshot++
+	writeJSON(w, 201, map[string]string{
+		"snapshot_id": strconv.Itoa(p.snapshot),
+	})
+}
+
+func (s *Server) replaceTracks(w http.ResponseWriter, r *http.Request,
+	p *playlist, body []byte) {
+	uris, err := parseURIs(r, body)
+	if err != nil || len(uris) > 100 {
+		writeError(w, 400, "Invalid track uris")
+		return
+	}
+	p.tracks = p.tracks[:0]
+	for _, uri := range uris {
+		p.tracks = append(p.tracks, s.track(uri))
+	}
+	p.snapshot++
+	writeJSON(w, 201, map[string]string{
+		"snapshot_id": strconv.Itoa(p.snapshot),
+	})
+}
+
+func (s *Server) deleteTracks(w http.ResponseWriter, p *playlist,
+	body []byte) {
+	var request struct {
+		Tracks []struct {
+			Uri       string `json:"uri"`
+			Positions []int  `json:"positions"`
+		} `json:"tracks"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil ||
+		len(request.Tracks) == 0 {
+		writeError(w, 400, "Invalid tracks")
+		return
+	}
+	remove := make(map[int]bool)
+	for _, t := range request.Tracks {
+		for i, track := range p.tracks {
+			if track.Uri != t.Uri {
+				continue
+			}
+			if len(t.Positions) == 0 {
+				remove[i] = true
+			}
+			for _, pos := range t.Positions {
+				if pos == i {
+					remove[i] = true
+				}
+			}
+		}
+	}
+	tracks := p.tracks[:0]
+	for i, track := range p.tracks {
+		if !remove[i] {
+			tracks = append(tracks, track)
+		}
+	}
+	p.tracks = tracks
+	p.snapshot++
+	writeJSON(w, 200, map[string]string{
+		"snapshot_id": strconv.Itoa(p.snapshot),
+	})
+}
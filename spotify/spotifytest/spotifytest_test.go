@@ -0,0 +1,356 @@
+package spotifytest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/spotify"
+)
+
+func TestPlaylists(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+
+	playlist, err := client.GetOrCreatePlaylist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := client.GetOrCreatePlaylist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.Id != existing.Id {
+		t.Fatalf("Expected playlist %s, got %s", playlist.Id,
+			existing.Id)
+	}
+	if n := server.Count("POST", "/v1/users/gopher/playlists"); n != 1 {
+		t.Fatalf("Expected 1 playlist to be created, got %d", n)
+	}
+}
+
+func TestPlaylistsPaginated(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.PageSize = 10
+	client := server.Spotify()
+	for i := 0; i < 25; i++ {
+		server.CreatePlaylist(fmt.Sprintf("Playlist %d", i))
+	}
+
+	playlists, err := client.Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 25 {
+		t.Fatalf("Expected 25 playlists, got %d", len(playlists))
+	}
+	// The last playlist is on the last page, and is not created again
+	if _, err := client.GetOrCreatePlaylist("Playlist 24"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Count("POST", "/v1/users/gopher/playlists"); n != 0 {
+		t.Fatalf("Expected no playlist to be created, got %d", n)
+	}
+}
+
+func TestAddAndDeleteTracks(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+	a := server.AddTrack("Bob Dylan", "Like a Rolling Stone")
+	b := server.AddTrack("The Band", "The Weight")
+
+	playlist, err := client.GetOrCreatePlaylist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddTracks(playlist, []spotify.Track{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteTrack(playlist, &a); err != nil {
+		t.Fatal(err)
+	}
+	tracks := server.Tracks("NRK P3")
+	if len(tracks) != 1 || tracks[0] != b {
+		t.Fatalf("Expected [%+v], got %+v", b, tracks)
+	}
+}
+
+func TestReplaceTracks(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+	tracks := make([]spotify.Track, 150)
+	for i := range tracks {
+		tracks[i] = server.AddTrack("Artist", fmt.Sprintf("Track %d", i))
+	}
+	server.CreatePlaylist("NRK P3", tracks[:10]...)
+	playlist, err := client.Playlist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.ReplaceTracks(playlist, tracks[5:]); err != nil {
+		t.Fatal(err)
+	}
+	got := server.Tracks("NRK P3")
+	if len(got) != 145 || got[0] != tracks[5] || got[144] != tracks[149] {
+		t.Fatalf("Expected tracks 5 to 149, got %d tracks", len(got))
+	}
+	if n := server.Count("PUT", "/v1/users/gopher/playlists/"+
+		playlist.Id+"/tracks"); n != 1 {
+		t.Fatalf("Expected 1 replace request, got %d", n)
+	}
+
+	if err := client.ReplaceTracks(playlist, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Tracks("NRK P3"); len(got) != 0 {
+		t.Fatalf("Expected empty playlist, got %d tracks", len(got))
+	}
+}
+
+func TestSinkContains(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.PageSize = 10
+
+	tracks := make([]spotify.Track, 150)
+	for i := range tracks {
+		tracks[i] = server.AddTrack("Artist", fmt.Sprintf("Track %d", i))
+	}
+	id := server.CreatePlaylist("NRK P3", tracks[:148]...)
+	path := "/v1/users/gopher/playlists/" + id + "/tracks"
+	sink := server.Sink("NRK P3")
+	if err := sink.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first track is only on the first page, but all are indexed
+	for _, i := range []int{0, 147} {
+		found, err := sink.Contains(&tracks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("Expected track %d to be found", i)
+		}
+	}
+	if n := server.Count("GET", path); n != 15 {
+		t.Fatalf("Expected 15 page requests, got %d", n)
+	}
+
+	// Changes made by the sink do not require indexing again
+	if err := sink.Add(&tracks[148]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Delete(&tracks[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range map[int]bool{0: false, 148: true} {
+		found, err := sink.Contains(&tracks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != expected {
+			t.Fatalf("Expected track %d found=%t", i, expected)
+		}
+	}
+	if n := server.Count("GET", path); n != 15 {
+		t.Fatalf("Expected 15 page requests, got %d", n)
+	}
+
+	// Changes made by others do
+	client := server.Spotify()
+	playlist, err := client.Playlist("NRK P3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddTrack(playlist, &tracks[149]); err != nil {
+		t.Fatal(err)
+	}
+	found, err := sink.Contains(&tracks[149])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("Expected track added by others to be found")
+	}
+	if n := server.Count("GET", path); n != 30 {
+		t.Fatalf("Expected 30 page requests, got %d", n)
+	}
+}
+
+func TestSinkOpenExisting(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	sink := server.Sink("NRK P3")
+
+	found, err := sink.OpenExisting()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Expected playlist not to be found")
+	}
+	if n := server.Count("POST", "/v1/users/gopher/playlists"); n != 0 {
+		t.Fatalf("Expected no playlist to be created, got %d", n)
+	}
+	id := server.CreatePlaylist("NRK P3")
+	if found, err = sink.OpenExisting(); err != nil {
+		t.Fatal(err)
+	}
+	if !found || sink.ID() != id {
+		t.Fatalf("Expected playlist %s to be opened, got %q", id,
+			sink.ID())
+	}
+}
+
+func TestSearch(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+	track := server.AddTrack("Bob Dylan", "Like a Rolling Stone")
+
+	tracks, err := client.SearchArtistTrack("bob dylan", "like a rolling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0] != track {
+		t.Fatalf("Expected [%+v], got %+v", track, tracks)
+	}
+	tracks, err = client.SearchArtistTrack("Bob Dylan", "Hurricane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 0 {
+		t.Fatalf("Expected no tracks, got %+v", tracks)
+	}
+
+	server.AutoCatalog = true
+	tracks, err = client.SearchArtistTrack("Bob Dylan", "Hurricane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].Name != "Hurricane" {
+		t.Fatalf("Expected Hurricane, got %+v", tracks)
+	}
+}
+
+func TestSearchPaginated(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.PageSize = 10
+	client := server.Spotify()
+	for i := 0; i < 25; i++ {
+		server.AddTrack("Bob Dylan", fmt.Sprintf("Hurricane %d", i))
+	}
+
+	tracks, err := client.Search("artist:Bob Dylan track:Hurricane",
+		"track", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 20 {
+		t.Fatalf("Expected 20 tracks, got %d", len(tracks))
+	}
+	if n := server.Count("GET", "/v1/search"); n != 2 {
+		t.Fatalf("Expected 2 search requests, got %d", n)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+
+	server.ExpireToken()
+	if _, err := client.CurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Count("POST", "/api/token"); n != 1 {
+		t.Fatalf("Expected 1 token refresh, got %d", n)
+	}
+	if client.AccessToken != "access-2" {
+		t.Fatalf("Expected access-2, got %s", client.AccessToken)
+	}
+}
+
+func TestTokenRefreshConcurrent(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+
+	server.ExpireToken()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.CurrentUser(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Requests rejected with the same token share one refresh
+	if n := server.Count("POST", "/api/token"); n != 1 {
+		t.Fatalf("Expected 1 token refresh, got %d", n)
+	}
+}
+
+func TestFail(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client := server.Spotify()
+
+	server.Fail("/v1/me", http.StatusTooManyRequests, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := client.CurrentUser(); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+	if _, err := client.CurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()
+	if requests[0].Status != 429 || requests[2].Status != 200 {
+		t.Fatalf("Unexpected requests: %+v", requests)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Latency = 20 * time.Millisecond
+
+	start := time.Now()
+	if _, err := server.Spotify().CurrentUser(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < server.Latency {
+		t.Fatalf("Expected request to take at least %s, took %s",
+			server.Latency, elapsed)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	server := New()
+	server.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/v1/me", nil))
+	if requests := server.Requests(); len(requests) != 0 {
+		t.Fatalf("Expected no recorded requests, got %+v", requests)
+	}
+
+	server.Record = true
+	server.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/v1/me", nil))
+	if n := server.Count("GET", "/v1/me"); n != 1 {
+		t.Fatalf("Expected 1 recorded request, got %d", n)
+	}
+}
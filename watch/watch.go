@@ -0,0 +1,231 @@
+// Package watch implements a terminal dashboard of running syncs.
+package watch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/nrk"
+	"github.com/mpolden/nrk-spotify/server"
+)
+
+const (
+	// ANSI escape sequences used to redraw the dashboard in place
+	home       = "\033[H"
+	clearLine  = "\033[K"
+	clearBelow = "\033[J"
+	hideCursor = "\033[?25l"
+	showCursor = "\033[?25h"
+)
+
+// progressWidth is the width of the progress bar of the current track.
+const progressWidth = 30
+
+// results are the symbols and colors of search results.
+var results = map[string]struct{ symbol, color, label string }{
+	"added":         {"+", "green", "Added"},
+	"would_add":     {"~", "cyan", "Would add"},
+	"already_added": {"=", "dark_gray", "Already added"},
+	"not_found":     {"?", "yellow", "Not found"},
+	"failed":        {"!", "red", "Failed"},
+}
+
+// Source provides the status of a sync, such as *server.Sync.
+type Source interface {
+	Status() server.Status
+}
+
+// Channel is a sync shown on the dashboard.
+type Channel struct {
+	ID     string
+	Name   string
+	Source Source
+}
+
+// Tail keeps the last lines written to it.
+type Tail struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+	buf   []byte
+}
+
+// NewTail returns a tail keeping max lines.
+func NewTail(max int) *Tail {
+	return &Tail{max: max}
+}
+
+func (t *Tail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.buf[:i]))
+		t.buf = t.buf[i+1:]
+	}
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+	return len(p), nil
+}
+
+// Lines returns the kept lines, oldest first.
+func (t *Tail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// Dashboard shows what each channel is playing, the latest search results
+// and when the next sync is.
+type Dashboard struct {
+	Channels []Channel
+	// Log is shown below the channels, if set
+	Log    *Tail
+	Colors bool
+	Clock  clock.Clock
+}
+
+func (d *Dashboard) colorize() *colorstring.Colorize {
+	return &colorstring.Colorize{
+		Colors:  colorstring.DefaultColors,
+		Disable: !d.Colors,
+		Reset:   true,
+	}
+}
+
+// position returns the position of track at now.
+func position(track *server.TrackStatus, now time.Time) nrk.Position {
+	duration := time.Duration(track.Duration * float64(time.Second))
+	var elapsed time.Duration
+	if track.StartTime != nil {
+		elapsed = now.Truncate(time.Second).Sub(*track.StartTime)
+	} else if track.Position != nil {
+		elapsed = time.Duration(*track.Position * float64(time.Second))
+	}
+	if elapsed > duration {
+		elapsed = duration
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return nrk.Position{Position: elapsed, Duration: duration}
+}
+
+func trackName(track *server.TrackStatus) string {
+	if track.Artist == "" {
+		return track.Title
+	}
+	return track.Artist + " - " + track.Title
+}
+
+// countdown returns the time until the next sync.
+func countdown(status *server.Status, now time.Time) string {
+	if status.NextSync == nil || !status.NextSync.After(now) {
+		return "syncing"
+	}
+	left := status.NextSync.Sub(now).Truncate(time.Second)
+	return "next sync in " + left.String()
+}
+
+func (d *Dashboard) now() time.Time {
+	return clock.OrReal(d.Clock).Now()
+}
+
+func (d *Dashboard) renderChannel(w io.Writer, c Channel, now time.Time) {
+	colors := d.colorize()
+	status := c.Source.Status()
+	fmt.Fprintf(w, colors.Color("[bold]%s[reset] (%s) - %s\n"), c.Name,
+		c.ID, countdown(&status, now))
+	fmt.Fprintf(w, "  Playlist  %s\n", status.Playlist.Name)
+	if run := status.LastRun; run != nil && run.Error != "" {
+		fmt.Fprintf(w, colors.Color("  [red]Last run failed: %s\n"),
+			run.Error)
+	}
+	playing := status.Now
+	if playing == nil || playing.Current == nil {
+		fmt.Fprintf(w, "  Now       unknown\n")
+	} else {
+		fmt.Fprintf(w, "  Now       %s\n", trackName(playing.Current))
+		if playing.Current.Duration > 0 {
+			p := position(playing.Current, now)
+			fmt.Fprintf(w, "            [%s] %s\n",
+				p.Symbol(progressWidth, d.Colors), p.String())
+		}
+		if playing.Next != nil {
+			fmt.Fprintf(w, "  Next      %s\n",
+				trackName(playing.Next))
+		}
+	}
+	if len(status.Recent) > 0 {
+		fmt.Fprintf(w, "  Recent\n")
+	}
+	for _, m := range status.Recent {
+		r, ok := results[m.Result]
+		if !ok {
+			r.symbol, r.label = " ", m.Result
+		}
+		line := fmt.Sprintf("    %s %s %-13s %s",
+			m.Time.Format("15:04"), r.symbol, r.label, m.Track)
+		if m.Spotify != "" && m.Spotify != m.Track {
+			line += " -> " + m.Spotify
+		}
+		if r.color != "" {
+			line = colors.Color("[" + r.color + "]" + line)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// Render writes one frame of the dashboard to w.
+func (d *Dashboard) Render(w io.Writer) {
+	now := d.now()
+	for i, c := range d.Channels {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		d.renderChannel(w, c, now)
+	}
+	if d.Log == nil {
+		return
+	}
+	if lines := d.Log.Lines(); len(lines) > 0 {
+		fmt.Fprintf(w, "\n%s\n", d.colorize().Color("[bold]Log"))
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// Run redraws the dashboard on out every refresh interval, until stop is
+// closed.
+func (d *Dashboard) Run(out io.Writer, refresh time.Duration,
+	stop <-chan struct{}) {
+	io.WriteString(out, hideCursor+home+clearBelow)
+	defer io.WriteString(out, showCursor)
+	for {
+		var frame bytes.Buffer
+		d.Render(&frame)
+		// Clear the rest of each line, as the previous frame may have
+		// been wider
+		lines := strings.Split(strings.TrimSuffix(frame.String(), "\n"),
+			"\n")
+		io.WriteString(out, home+strings.Join(lines, clearLine+"\n")+
+			clearLine+"\n"+clearBelow)
+		select {
+		case <-stop:
+			return
+		case <-clock.OrReal(d.Clock).After(refresh):
+		}
+	}
+}
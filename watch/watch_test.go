@@ -0,0 +1,114 @@
+package watch
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/nrk-spotify/clock"
+	"github.com/mpolden/nrk-spotify/server"
+)
+
+type testSource struct {
+	status server.Status
+}
+
+func (s *testSource) Status() server.Status { return s.status }
+
+func TestTail(t *testing.T) {
+	tail := NewTail(2)
+	fmt.Fprint(tail, "one\ntwo\nthr")
+	fmt.Fprint(tail, "ee\nfour")
+	expected := []string{"two", "three"}
+	if lines := tail.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestRender(t *testing.T) {
+	start := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := clock.NewFake(start)
+	source := &testSource{status: server.Status{
+		Playlist: server.PlaylistStatus{Name: "NRK P3"},
+	}}
+	tail := NewTail(5)
+	fmt.Fprintln(tail, "Sync finished")
+	d := &Dashboard{
+		Channels: []Channel{{ID: "p3", Name: "NRK P3", Source: source}},
+		Log:      tail,
+		Clock:    clock,
+	}
+
+	var buf bytes.Buffer
+	d.Render(&buf)
+	expected := `NRK P3 (p3) - syncing
+  Playlist  NRK P3
+  Now       unknown
+
+Log
+Sync finished
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	trackStart := start.Add(-time.Minute)
+	next := start.Add(5 * time.Minute)
+	source.status.Now = &server.NowStatus{
+		Radio: "NRK P3",
+		Current: &server.TrackStatus{
+			Artist:    "Bob Dylan",
+			Title:     "Like a Rolling Stone",
+			StartTime: &trackStart,
+			Duration:  240,
+		},
+		Next: &server.TrackStatus{Artist: "The Band",
+			Title: "The Weight"},
+	}
+	source.status.NextSync = &next
+	source.status.LastRun = &server.RunStatus{Error: "gopher says no"}
+	source.status.Recent = []server.MatchStatus{
+		{Time: start, Track: "The Band - The Weight",
+			Result: "not_found"},
+		{Time: start, Track: "Bob Dylan - Like a Rolling Stone",
+			Spotify: "Bob Dylan - Like a Rolling Stone (Live)",
+			Result:  "added"},
+	}
+	// The position moves with the clock
+	clock.Advance(2 * time.Minute)
+	buf.Reset()
+	d.Render(&buf)
+	expected = `NRK P3 (p3) - next sync in 3m0s
+  Playlist  NRK P3
+  Last run failed: gopher says no
+  Now       Bob Dylan - Like a Rolling Stone
+            [=======================-------] 03:00/04:00
+  Next      The Band - The Weight
+  Recent
+    12:00 ? Not found     The Band - The Weight
+    12:00 + Added         Bob Dylan - Like a Rolling Stone -> ` +
+		`Bob Dylan - Like a Rolling Stone (Live)
+
+Log
+Sync finished
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	d := &Dashboard{Clock: clock.NewFake(time.Now())}
+	stop := make(chan struct{})
+	close(stop)
+	var buf bytes.Buffer
+	d.Run(&buf, time.Second, stop)
+	if !strings.HasPrefix(buf.String(), hideCursor) ||
+		!strings.HasSuffix(buf.String(), showCursor) {
+		t.Fatalf("Expected cursor to be hidden and restored, got %q",
+			buf.String())
+	}
+}